@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"ranklogger/config"
+	"ranklogger/database"
+	"ranklogger/handlers"
+)
+
+// サブコマンドの実行（サーバーを起動せずに管理作業を行う）
+//
+//	./main backup [出力先ディレクトリ]   稼働中でも実行可能。省略時はBACKUP:DIR
+//	./main restore <スナップショット>      サーバーを停止してから実行する（DBが使用中の場合は中止する）
+//	./main import records <ファイル> [タグ] 過去のレコードを一括登録する（拡張子が.csvならCSV、それ以外はNDJSON）
+//	./main import logs <ファイル>           過去のログを一括登録する
+func runCommand(cfg *config.Config, args []string) error {
+	switch args[0] {
+	case "backup":
+		dir := cfg.Backup.Dir
+		if len(args) > 1 {
+			dir = args[1]
+		}
+		// 稼働中のDBにマイグレーションなどを実行しないよう、読み取り専用で開く
+		db, err := database.OpenReadOnly(cfg.Server.DBPath)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		path, err := database.Backup(context.Background(), db, dir)
+		if err != nil {
+			return err
+		}
+		log.Printf("Backup created: %s", path)
+		return nil
+
+	case "restore":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: main restore <snapshot file>")
+		}
+		saved, err := database.Restore(cfg, args[1])
+		if err != nil {
+			return err
+		}
+		if saved != "" {
+			log.Printf("Previous database saved as: %s", saved)
+		}
+		log.Printf("Restored %s to %s", args[1], cfg.Server.DBPath)
+		return nil
+
+	case "import":
+		if len(args) < 3 || (args[1] != "records" && args[1] != "logs") {
+			return fmt.Errorf("usage: main import records <file> [tag] | main import logs <file>")
+		}
+		return runImport(cfg, args[1], args[2:])
+
+	default:
+		return fmt.Errorf("unknown command: %s (available: backup, restore, import)", args[0])
+	}
+}
+
+func runImport(cfg *config.Config, target string, args []string) error {
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format := "ndjson"
+	if strings.EqualFold(filepath.Ext(args[0]), ".csv") {
+		format = "csv"
+	}
+
+	db, err := database.InitDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	var report *handlers.ImportReport
+	if target == "records" {
+		tag := ""
+		if len(args) > 1 {
+			tag = args[1]
+		}
+		report, err = handlers.ImportRecords(ctx, db, cfg, tag, format, f)
+	} else {
+		report, err = handlers.ImportLogs(ctx, db, cfg, format, f)
+	}
+	if report != nil {
+		for _, e := range report.Errors {
+			log.Printf("line %d: %s", e.Line, e.Error)
+		}
+		if report.ErrorsTruncated {
+			log.Printf("... (showing first %d errors)", len(report.Errors))
+		}
+		log.Printf("Imported %d of %d %s (%d failed)", report.Imported, report.Total, target, report.Failed)
+	}
+	return err
+}
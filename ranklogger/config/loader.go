@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/spf13/viper"
@@ -12,8 +13,24 @@ type (
 		Server          ServerConfig            `mapstructure:"SERVER"`
 		Auth            AuthConfig              `mapstructure:"AUTH"`
 		Retention       RetentionConfig         `mapstructure:"RETENTION"`
+		AuditLog        AuditLogConfig          `mapstructure:"AUDIT_LOG"`
+		Tracing         TracingConfig           `mapstructure:"TRACING"`
+		Health          HealthConfig            `mapstructure:"HEALTH"`
+		Maintenance     MaintenanceConfig       `mapstructure:"MAINTENANCE"`
+		Backup          BackupConfig            `mapstructure:"BACKUP"`
+		Import          ImportConfig            `mapstructure:"IMPORT"`
+		Submission      SubmissionConfig        `mapstructure:"SUBMISSION"`
+		Idempotency     IdempotencyConfig       `mapstructure:"IDEMPOTENCY"`
+		ContentFilter   ContentFilterConfig     `mapstructure:"CONTENT_FILTER"`
+		Stream          StreamConfig            `mapstructure:"STREAM"`
+		Webhook         WebhookConfig           `mapstructure:"WEBHOOK"`
+		Distribution    DistributionConfig      `mapstructure:"DISTRIBUTION"`
+		Groups          GroupsConfig            `mapstructure:"GROUPS"`
 		Limits          RateLimitConfig         `mapstructure:"RATE_LIMITS"`
 		Schema          []SchemaConfig          `mapstructure:"RECORD_SCHEMA"`
+		PlayerSchema    []SchemaConfig          `mapstructure:"PLAYER_SCHEMA"`
+		LogSchema       []LogSchemaConfig       `mapstructure:"LOG_SCHEMA"`
+		LogTypes        []LogTypeConfig         `mapstructure:"LOG_TYPES"`
 		SortableColumns map[string][]SortOption `json:"sortable_columns"`
 		TypeValidation  TypeConfig              `mapstructure:"TYPE_VALIDATION"`
 	}
@@ -27,6 +44,7 @@ type (
 		CORSAllowOrigins []string `mapstructure:"CORS_ALLOW_ORIGINS"`
 		ClientIpFromLast int      `mapstructure:"CLIENT_IP_FROM_LAST"`
 		EnablePlayCount  bool     `mapstructure:"ENABLE_PLAY_COUNT"`
+		BodyLimitMB      int      `mapstructure:"BODY_LIMIT_MB"`
 	}
 
 	AuthConfig struct {
@@ -36,7 +54,132 @@ type (
 	}
 
 	RetentionConfig struct {
-		LogRetentionDays int `mapstructure:"LOG_RETENTION_DAYS"`
+		LogRetentionDays    int                    `mapstructure:"LOG_RETENTION_DAYS"`
+		TypeRules           []LogRetentionRule     `mapstructure:"TYPE_RULES"`
+		DisabledSessionDays int                    `mapstructure:"DISABLED_SESSION_DAYS"`
+		UnrankedSessionDays int                    `mapstructure:"UNRANKED_SESSION_DAYS"`
+		Archive             RetentionArchiveConfig `mapstructure:"ARCHIVE"`
+	}
+
+	LogRetentionRule struct {
+		Type int `mapstructure:"TYPE"`
+		Days int `mapstructure:"DAYS"`
+	}
+
+	RetentionArchiveConfig struct {
+		Enabled bool   `mapstructure:"ENABLED"`
+		Dir     string `mapstructure:"DIR"`
+	}
+
+	AuditLogConfig struct {
+		Enabled       bool     `mapstructure:"ENABLED"`
+		Output        string   `mapstructure:"OUTPUT"`
+		FilePath      string   `mapstructure:"FILE_PATH"`
+		MaxSizeMB     int      `mapstructure:"MAX_SIZE_MB"`
+		MaxBackups    int      `mapstructure:"MAX_BACKUPS"`
+		ExcludePaths  []string `mapstructure:"EXCLUDE_PATHS"`
+		LogHeaders    bool     `mapstructure:"LOG_HEADERS"`
+		RedactHeaders []string `mapstructure:"REDACT_HEADERS"`
+		LogBodies     bool     `mapstructure:"LOG_BODIES"`
+		RedactFields  []string `mapstructure:"REDACT_FIELDS"`
+		MaxBodyBytes  int      `mapstructure:"MAX_BODY_BYTES"`
+	}
+
+	TracingConfig struct {
+		Enabled      bool    `mapstructure:"ENABLED"`
+		Exporter     string  `mapstructure:"EXPORTER"`
+		OTLPEndpoint string  `mapstructure:"OTLP_ENDPOINT"`
+		OTLPInsecure bool    `mapstructure:"OTLP_INSECURE"`
+		FilePath     string  `mapstructure:"FILE_PATH"`
+		SampleRatio  float64 `mapstructure:"SAMPLE_RATIO"`
+		ServiceName  string  `mapstructure:"SERVICE_NAME"`
+	}
+
+	MaintenanceConfig struct {
+		Enabled                           bool `mapstructure:"ENABLED"`
+		LogCleanupIntervalMinutes         int  `mapstructure:"LOG_CLEANUP_INTERVAL_MINUTES"`
+		VacuumIntervalMinutes             int  `mapstructure:"VACUUM_INTERVAL_MINUTES"`
+		VacuumPages                       int  `mapstructure:"VACUUM_PAGES"`
+		CheckpointIntervalMinutes         int  `mapstructure:"CHECKPOINT_INTERVAL_MINUTES"`
+		OptimizeIntervalMinutes           int  `mapstructure:"OPTIMIZE_INTERVAL_MINUTES"`
+		DeleteBatchSize                   int  `mapstructure:"DELETE_BATCH_SIZE"`
+		StaleSessionDays                  int  `mapstructure:"STALE_SESSION_DAYS"`
+		SessionPruneIntervalMinutes       int  `mapstructure:"SESSION_PRUNE_INTERVAL_MINUTES"`
+		IdempotencyCleanupIntervalMinutes int  `mapstructure:"IDEMPOTENCY_CLEANUP_INTERVAL_MINUTES"`
+		WebhookCleanupIntervalMinutes     int  `mapstructure:"WEBHOOK_CLEANUP_INTERVAL_MINUTES"`
+	}
+
+	BackupConfig struct {
+		Dir             string `mapstructure:"DIR"`
+		IntervalMinutes int    `mapstructure:"INTERVAL_MINUTES"`
+		Keep            int    `mapstructure:"KEEP"`
+	}
+
+	SubmissionConfig struct {
+		MaxBatchSize             int `mapstructure:"MAX_BATCH_SIZE"`
+		PlayedAtMaxPastDays      int `mapstructure:"PLAYED_AT_MAX_PAST_DAYS"`
+		PlayedAtMaxFutureSeconds int `mapstructure:"PLAYED_AT_MAX_FUTURE_SECONDS"`
+	}
+
+	IdempotencyConfig struct {
+		Enabled     bool `mapstructure:"ENABLED"`
+		WindowHours int  `mapstructure:"WINDOW_HOURS"`
+	}
+
+	ContentFilterConfig struct {
+		Enabled           bool     `mapstructure:"ENABLED"`
+		WordLists         []string `mapstructure:"WORD_LISTS"`
+		PatternLists      []string `mapstructure:"PATTERN_LISTS"`
+		MaskChar          string   `mapstructure:"MASK_CHAR"`
+		DisplayNamePolicy string   `mapstructure:"DISPLAY_NAME_POLICY"`
+		LogPolicy         string   `mapstructure:"LOG_POLICY"`
+	}
+
+	StreamConfig struct {
+		MaxConnections      int `mapstructure:"MAX_CONNECTIONS"`
+		MaxConnectionsPerIP int `mapstructure:"MAX_CONNECTIONS_PER_IP"`
+		HeartbeatSeconds    int `mapstructure:"HEARTBEAT_SECONDS"`
+		MinIntervalMs       int `mapstructure:"MIN_INTERVAL_MS"`
+	}
+
+	DistributionConfig struct {
+		RefreshSeconds int   `mapstructure:"REFRESH_SECONDS"`
+		Bins           int   `mapstructure:"BINS"`
+		Percentiles    []int `mapstructure:"PERCENTILES"`
+	}
+
+	GroupsConfig struct {
+		MaxMembers        int `mapstructure:"MAX_MEMBERS"`
+		MaxGroupsPerOwner int `mapstructure:"MAX_GROUPS_PER_OWNER"`
+	}
+
+	WebhookConfig struct {
+		Enabled             bool              `mapstructure:"ENABLED"`
+		TimeoutSeconds      int               `mapstructure:"TIMEOUT_SECONDS"`
+		MaxAttempts         int               `mapstructure:"MAX_ATTEMPTS"`
+		BackoffBaseSeconds  int               `mapstructure:"BACKOFF_BASE_SECONDS"`
+		BackoffMaxSeconds   int               `mapstructure:"BACKOFF_MAX_SECONDS"`
+		PollIntervalSeconds int               `mapstructure:"POLL_INTERVAL_SECONDS"`
+		RetentionDays       int               `mapstructure:"RETENTION_DAYS"`
+		ErrorLogTypes       []int             `mapstructure:"ERROR_LOG_TYPES"`
+		Endpoints           []WebhookEndpoint `mapstructure:"ENDPOINTS"`
+	}
+
+	WebhookEndpoint struct {
+		Name   string   `mapstructure:"NAME"`
+		URL    string   `mapstructure:"URL"`
+		Secret string   `mapstructure:"SECRET"`
+		Events []string `mapstructure:"EVENTS"`
+	}
+
+	ImportConfig struct {
+		BatchSize int `mapstructure:"BATCH_SIZE"`
+		MaxErrors int `mapstructure:"MAX_ERRORS"`
+	}
+
+	HealthConfig struct {
+		MaxWALSizeMB         int `mapstructure:"MAX_WAL_SIZE_MB"`
+		ShutdownDelaySeconds int `mapstructure:"SHUTDOWN_DELAY_SECONDS"`
 	}
 
 	RateLimitConfig struct {
@@ -58,6 +201,22 @@ type (
 		Max      *int   `mapstructure:"MAX"`
 		Tag      string `mapstructure:"TAG"`
 		IsGlobal bool   `mapstructure:"IS_GLOBAL"`
+		Merge    string `mapstructure:"MERGE"`
+		Filter   string `mapstructure:"FILTER"`
+	}
+
+	// ログの種類（type）ごとの構造化データ（logs.data）の項目
+	LogSchemaConfig struct {
+		Type   int            `mapstructure:"TYPE"`
+		Fields []SchemaConfig `mapstructure:"FIELDS"`
+	}
+
+	// ログの種類（typeのIDに名前・重要度・保持期間を付ける）
+	LogTypeConfig struct {
+		ID            int    `mapstructure:"ID"`
+		Name          string `mapstructure:"NAME"`
+		Severity      string `mapstructure:"SEVERITY"`
+		RetentionDays *int   `mapstructure:"RETENTION_DAYS"` // 省略時はLOG_RETENTION_DAYS
 	}
 
 	SortOption struct {
@@ -84,6 +243,57 @@ func LoadConfig() (*Config, error) {
 	viper.SetDefault("SERVER.READ_LIMIT", 100)
 	viper.SetDefault("SERVER.CORS_ALLOW_ORIGINS", "*")
 	viper.SetDefault("SERVER.CLIENT_IP_FROM_LAST", 1)
+	viper.SetDefault("SERVER.BODY_LIMIT_MB", 4)
+	viper.SetDefault("AUDIT_LOG.ENABLED", true)
+	viper.SetDefault("AUDIT_LOG.OUTPUT", "stdout")
+	viper.SetDefault("AUDIT_LOG.FILE_PATH", "./data/audit.log")
+	viper.SetDefault("AUDIT_LOG.MAX_SIZE_MB", 100)
+	viper.SetDefault("AUDIT_LOG.MAX_BACKUPS", 5)
+	viper.SetDefault("AUDIT_LOG.EXCLUDE_PATHS", []string{"/doc/"})
+	viper.SetDefault("AUDIT_LOG.REDACT_HEADERS", []string{"Authorization", "X-Game-Key", "Cookie"})
+	viper.SetDefault("AUDIT_LOG.LOG_BODIES", true)
+	viper.SetDefault("AUDIT_LOG.MAX_BODY_BYTES", 2048)
+	viper.SetDefault("BACKUP.DIR", "./data/backups")
+	viper.SetDefault("BACKUP.KEEP", 7)
+	viper.SetDefault("SUBMISSION.MAX_BATCH_SIZE", 50)
+	viper.SetDefault("SUBMISSION.PLAYED_AT_MAX_PAST_DAYS", 30)
+	viper.SetDefault("SUBMISSION.PLAYED_AT_MAX_FUTURE_SECONDS", 300)
+	viper.SetDefault("IDEMPOTENCY.ENABLED", true)
+	viper.SetDefault("IDEMPOTENCY.WINDOW_HOURS", 24)
+	viper.SetDefault("CONTENT_FILTER.MASK_CHAR", "*")
+	viper.SetDefault("STREAM.MAX_CONNECTIONS", 100)
+	viper.SetDefault("STREAM.MAX_CONNECTIONS_PER_IP", 5)
+	viper.SetDefault("STREAM.HEARTBEAT_SECONDS", 15)
+	viper.SetDefault("STREAM.MIN_INTERVAL_MS", 1000)
+	viper.SetDefault("DISTRIBUTION.REFRESH_SECONDS", 300)
+	viper.SetDefault("DISTRIBUTION.BINS", 20)
+	viper.SetDefault("DISTRIBUTION.PERCENTILES", []int{50, 90, 99})
+	viper.SetDefault("GROUPS.MAX_MEMBERS", 100)
+	viper.SetDefault("GROUPS.MAX_GROUPS_PER_OWNER", 20)
+	viper.SetDefault("WEBHOOK.TIMEOUT_SECONDS", 10)
+	viper.SetDefault("WEBHOOK.MAX_ATTEMPTS", 8)
+	viper.SetDefault("WEBHOOK.BACKOFF_BASE_SECONDS", 30)
+	viper.SetDefault("WEBHOOK.BACKOFF_MAX_SECONDS", 3600)
+	viper.SetDefault("WEBHOOK.POLL_INTERVAL_SECONDS", 10)
+	viper.SetDefault("WEBHOOK.RETENTION_DAYS", 30)
+	viper.SetDefault("IMPORT.BATCH_SIZE", 500)
+	viper.SetDefault("IMPORT.MAX_ERRORS", 100)
+	viper.SetDefault("HEALTH.MAX_WAL_SIZE_MB", 256)
+	viper.SetDefault("RETENTION.ARCHIVE.DIR", "./data/archive")
+	viper.SetDefault("MAINTENANCE.ENABLED", true)
+	viper.SetDefault("MAINTENANCE.LOG_CLEANUP_INTERVAL_MINUTES", 60)
+	viper.SetDefault("MAINTENANCE.VACUUM_INTERVAL_MINUTES", 360)
+	viper.SetDefault("MAINTENANCE.CHECKPOINT_INTERVAL_MINUTES", 10)
+	viper.SetDefault("MAINTENANCE.OPTIMIZE_INTERVAL_MINUTES", 1440)
+	viper.SetDefault("MAINTENANCE.DELETE_BATCH_SIZE", 1000)
+	viper.SetDefault("MAINTENANCE.SESSION_PRUNE_INTERVAL_MINUTES", 1440)
+	viper.SetDefault("MAINTENANCE.IDEMPOTENCY_CLEANUP_INTERVAL_MINUTES", 60)
+	viper.SetDefault("MAINTENANCE.WEBHOOK_CLEANUP_INTERVAL_MINUTES", 60)
+	viper.SetDefault("TRACING.EXPORTER", "file")
+	viper.SetDefault("TRACING.OTLP_ENDPOINT", "localhost:4318")
+	viper.SetDefault("TRACING.FILE_PATH", "./data/traces.jsonl")
+	viper.SetDefault("TRACING.SAMPLE_RATIO", 1.0)
+	viper.SetDefault("TRACING.SERVICE_NAME", "ranklogger")
 	// 0やfalseをデフォルト値にする項目はUnmarshalで設定される
 
 	if err := viper.ReadInConfig(); err != nil {
@@ -101,21 +311,153 @@ func LoadConfig() (*Config, error) {
 	if cfg.Auth.AdminPasswordHash == "" {
 		return nil, fmt.Errorf("管理者パスワードの設定をしてください。\nconfig.yamlの中のAUTH:ADMIN_PASSWORD_HASHを確認してください。")
 	}
+	seenTypes := make(map[int]bool)
+	for _, rule := range cfg.Retention.TypeRules {
+		if seenTypes[rule.Type] {
+			return nil, fmt.Errorf("ログの種類 %d の保持期間が複数設定されています。\nconfig.yamlの中のRETENTION:TYPE_RULESを確認してください。", rule.Type)
+		}
+		seenTypes[rule.Type] = true
+	}
+	// ログの種類。設定がない場合は、これまでどおり1以上のすべてのtypeを受け付ける
+	seenLogTypeIds := make(map[int]bool)
+	seenLogTypeNames := make(map[string]bool)
+	for i, t := range cfg.LogTypes {
+		if t.ID < 1 {
+			return nil, fmt.Errorf("ログの種類のIDは1以上にしてください。\nconfig.yamlの中のLOG_TYPESを確認してください。")
+		}
+		if seenLogTypeIds[t.ID] {
+			return nil, fmt.Errorf("ログの種類のID %d が複数設定されています。\nconfig.yamlの中のLOG_TYPESを確認してください。", t.ID)
+		}
+		seenLogTypeIds[t.ID] = true
+		// 名前は ?type=error のようにIDの代わりに使うため、数字だけやカンマを含むものは使えない
+		if t.Name == "" || strings.Trim(t.Name, "0123456789") == "" || strings.ContainsAny(t.Name, ", ") {
+			return nil, fmt.Errorf("ログの種類 %d の名前 %q は使用できません（数字だけの名前、カンマや空白を含む名前は不可）。\nconfig.yamlの中のLOG_TYPESを確認してください。", t.ID, t.Name)
+		}
+		if seenLogTypeNames[t.Name] {
+			return nil, fmt.Errorf("ログの種類の名前 %s が複数設定されています。\nconfig.yamlの中のLOG_TYPESを確認してください。", t.Name)
+		}
+		seenLogTypeNames[t.Name] = true
+		severity := strings.ToLower(t.Severity)
+		if severity == "" {
+			severity = "info"
+		}
+		if !slices.Contains(logSeverities, severity) {
+			return nil, fmt.Errorf("%s はログの重要度に使用できません（debug, info, warning, error, criticalのいずれか）。\nconfig.yamlの中のLOG_TYPESを確認してください。", t.Severity)
+		}
+		cfg.LogTypes[i].Severity = severity
+		// 保持期間はRETENTION:TYPE_RULESと同じように扱う
+		if t.RetentionDays != nil {
+			if seenTypes[t.ID] {
+				return nil, fmt.Errorf("ログの種類 %d の保持期間がLOG_TYPESとRETENTION:TYPE_RULESの両方に設定されています。\nconfig.yamlの中のLOG_TYPESを確認してください。", t.ID)
+			}
+			seenTypes[t.ID] = true
+			cfg.Retention.TypeRules = append(cfg.Retention.TypeRules, LogRetentionRule{Type: t.ID, Days: *t.RetentionDays})
+		}
+	}
+	if cfg.Maintenance.DeleteBatchSize <= 0 {
+		return nil, fmt.Errorf("削除のバッチサイズは1以上にしてください。\nconfig.yamlの中のMAINTENANCE:DELETE_BATCH_SIZEを確認してください。")
+	}
+	if cfg.Submission.MaxBatchSize <= 0 {
+		return nil, fmt.Errorf("一度に送れるレコードの数は1以上にしてください。\nconfig.yamlの中のSUBMISSION:MAX_BATCH_SIZEを確認してください。")
+	}
+	if cfg.Idempotency.Enabled && cfg.Idempotency.WindowHours <= 0 {
+		return nil, fmt.Errorf("Idempotency-Keyの保持期間は1時間以上にしてください。\nconfig.yamlの中のIDEMPOTENCY:WINDOW_HOURSを確認してください。")
+	}
+	if cfg.Stream.MaxConnections <= 0 || cfg.Stream.MaxConnectionsPerIP <= 0 {
+		return nil, fmt.Errorf("ストリーミングの接続数の上限は1以上にしてください。\nconfig.yamlの中のSTREAM:MAX_CONNECTIONS, MAX_CONNECTIONS_PER_IPを確認してください。")
+	}
+	if cfg.Stream.HeartbeatSeconds <= 0 {
+		return nil, fmt.Errorf("ハートビートの間隔は1秒以上にしてください。\nconfig.yamlの中のSTREAM:HEARTBEAT_SECONDSを確認してください。")
+	}
+	if cfg.Distribution.RefreshSeconds <= 0 {
+		return nil, fmt.Errorf("分布の再計算の間隔は1秒以上にしてください。\nconfig.yamlの中のDISTRIBUTION:REFRESH_SECONDSを確認してください。")
+	}
+	if cfg.Distribution.Bins < 1 || cfg.Distribution.Bins > 200 {
+		return nil, fmt.Errorf("分布の区間の数は1〜200にしてください。\nconfig.yamlの中のDISTRIBUTION:BINSを確認してください。")
+	}
+	for i, p := range cfg.Distribution.Percentiles {
+		if p < 1 || p > 99 || slices.Contains(cfg.Distribution.Percentiles[:i], p) {
+			return nil, fmt.Errorf("パーセンタイルは1〜99の重複しない値にしてください: %d\nconfig.yamlの中のDISTRIBUTION:PERCENTILESを確認してください。", p)
+		}
+	}
+	if cfg.Groups.MaxMembers <= 0 || cfg.Groups.MaxGroupsPerOwner <= 0 {
+		return nil, fmt.Errorf("グループの人数と作成できる数の上限は1以上にしてください。\nconfig.yamlの中のGROUPS:MAX_MEMBERS, MAX_GROUPS_PER_OWNERを確認してください。")
+	}
+	if err := validateWebhook(cfg.Webhook); err != nil {
+		return nil, err
+	}
+	for _, t := range cfg.Webhook.ErrorLogTypes {
+		if len(cfg.LogTypes) > 0 && !seenLogTypeIds[t] {
+			return nil, fmt.Errorf("ログの種類 %d がLOG_TYPESに設定されていません。\nconfig.yamlの中のWEBHOOK:ERROR_LOG_TYPESを確認してください。", t)
+		}
+	}
+	if cfg.Import.BatchSize <= 0 {
+		return nil, fmt.Errorf("インポートのバッチサイズは1以上にしてください。\nconfig.yamlの中のIMPORT:BATCH_SIZEを確認してください。")
+	}
+	if len([]rune(cfg.ContentFilter.MaskChar)) != 1 {
+		return nil, fmt.Errorf("伏せ字には1文字を設定してください。\nconfig.yamlの中のCONTENT_FILTER:MASK_CHARを確認してください。")
+	}
+	// プレイヤーの表示名は無効化できる対象がないため、reject, maskのみ
+	cfg.ContentFilter.DisplayNamePolicy = strings.ToLower(cfg.ContentFilter.DisplayNamePolicy)
+	if !slices.Contains([]string{"", "reject", "mask"}, cfg.ContentFilter.DisplayNamePolicy) {
+		return nil, fmt.Errorf("%s は表示名のフィルターに使用できません（reject, maskのいずれか）。\nconfig.yamlの中のCONTENT_FILTER:DISPLAY_NAME_POLICYを確認してください。", cfg.ContentFilter.DisplayNamePolicy)
+	}
+	cfg.ContentFilter.LogPolicy = strings.ToLower(cfg.ContentFilter.LogPolicy)
+	if !slices.Contains([]string{"", "reject", "mask", "disable"}, cfg.ContentFilter.LogPolicy) {
+		return nil, fmt.Errorf("%s はログのフィルターに使用できません（reject, mask, disableのいずれか）。\nconfig.yamlの中のCONTENT_FILTER:LOG_POLICYを確認してください。", cfg.ContentFilter.LogPolicy)
+	}
+	if exporter := strings.ToLower(cfg.Tracing.Exporter); exporter != "otlp" && exporter != "file" {
+		return nil, fmt.Errorf("%s はトレースの出力先に使用できません（otlp, fileのいずれか）。\nconfig.yamlの中のTRACING:EXPORTERを確認してください。", cfg.Tracing.Exporter)
+	}
+	if output := strings.ToLower(cfg.AuditLog.Output); output != "stdout" && output != "file" {
+		return nil, fmt.Errorf("%s は監査ログの出力先に使用できません（stdout, fileのいずれか）。\nconfig.yamlの中のAUDIT_LOG:OUTPUTを確認してください。", cfg.AuditLog.Output)
+	}
 
 	cfg.SortableColumns = make(map[string][]SortOption)
-	for _, field := range cfg.Schema {
+	for i, field := range cfg.Schema {
 		if field.Name == "" {
 			return nil, fmt.Errorf("名前が設定されていないレコードスキーマがあります。\nconfig.yamlの中のRECORD_SCHEMAを確認してください。")
 		}
-		if lowerTag := strings.ToLower(field.Tag); lowerTag == "detail" || lowerTag == "global" || lowerTag == "none" {
+		if lowerTag := strings.ToLower(field.Tag); lowerTag == "detail" || lowerTag == "global" || lowerTag == "none" || lowerTag == "batch" {
 			return nil, fmt.Errorf("%s はタグ名に使用できません。 \nconfig.yamlの中のRECORD_SCHEMAを確認してください。", field.Tag)
 		}
+		// 同じレコードに再登録されたときの値の決め方（設定になければreplace）
+		merge := strings.ToLower(field.Merge)
+		switch merge {
+		case "":
+			merge = "replace"
+		case "replace", "keep_first":
+		case "keep_best", "max", "min", "sum":
+			if !slices.Contains(cfg.TypeValidation.Numbers, field.Type) {
+				return nil, fmt.Errorf("%sのMERGE（%s）は数値型の項目にのみ設定できます。\nconfig.yamlの中のRECORD_SCHEMAを確認してください。", field.Name, merge)
+			}
+			if merge == "keep_best" && !field.IsIndex {
+				return nil, fmt.Errorf("%sのMERGE（keep_best）はIS_INDEXがtrueの項目にのみ設定できます（ORDERで良し悪しを判断するため）。\nconfig.yamlの中のRECORD_SCHEMAを確認してください。", field.Name)
+			}
+		default:
+			return nil, fmt.Errorf("%s はMERGEに使用できません（replace, keep_best, max, min, sum, keep_firstのいずれか）。\nconfig.yamlの中のRECORD_SCHEMAを確認してください。", field.Merge)
+		}
+		cfg.Schema[i].Merge = merge
+
+		// 不適切な表現が含まれていたときの対応（文字列型のみ）
+		filter := strings.ToLower(field.Filter)
+		if filter != "" {
+			if !slices.Contains([]string{"reject", "mask", "disable"}, filter) {
+				return nil, fmt.Errorf("%s はFILTERに使用できません（reject, mask, disableのいずれか）。\nconfig.yamlの中のRECORD_SCHEMAを確認してください。", field.Filter)
+			}
+			if !slices.Contains(cfg.TypeValidation.Strings, field.Type) {
+				return nil, fmt.Errorf("%sのFILTERは文字列型の項目にのみ設定できます。\nconfig.yamlの中のRECORD_SCHEMAを確認してください。", field.Name)
+			}
+		}
+		cfg.Schema[i].Filter = filter
+
 		if field.IsIndex {
 			// デフォルトの順序を設定（設定になければDESCにする）
 			order := strings.ToUpper(field.Order)
 			if order == "" {
 				order = "DESC"
 			}
+			cfg.Schema[i].Order = order
 			if field.Tag == "" {
 				if field.IsGlobal {
 					return nil, fmt.Errorf("%sのタグを設定するかIsGlobalをFalseにしてください。\nconfig.yamlの中のRECORD_SCHEMAを確認してください。", field.Name)
@@ -143,5 +485,120 @@ func LoadConfig() (*Config, error) {
 		}
 	}
 
+	// プレイヤープロフィールの独自項目（NAME, TYPE, MIN, MAX, FILTERのみ使用）
+	seenPlayerFields := make(map[string]bool)
+	for i, field := range cfg.PlayerSchema {
+		if field.Name == "" {
+			return nil, fmt.Errorf("名前が設定されていないプレイヤースキーマがあります。\nconfig.yamlの中のPLAYER_SCHEMAを確認してください。")
+		}
+		if seenPlayerFields[field.Name] {
+			return nil, fmt.Errorf("プレイヤースキーマの %s が複数設定されています。\nconfig.yamlの中のPLAYER_SCHEMAを確認してください。", field.Name)
+		}
+		seenPlayerFields[field.Name] = true
+		if !slices.Contains(cfg.TypeValidation.Numbers, field.Type) && !slices.Contains(cfg.TypeValidation.Strings, field.Type) {
+			return nil, fmt.Errorf("%s はプレイヤースキーマのTYPEに使用できません（TYPE_VALIDATIONに含まれる型のみ）。\nconfig.yamlの中のPLAYER_SCHEMAを確認してください。", field.Type)
+		}
+		if field.IsIndex || field.Tag != "" || field.Merge != "" {
+			return nil, fmt.Errorf("プレイヤースキーマの%sにはIS_INDEX, TAG, MERGEを設定できません。\nconfig.yamlの中のPLAYER_SCHEMAを確認してください。", field.Name)
+		}
+		filter := strings.ToLower(field.Filter)
+		if filter != "" {
+			if filter != "reject" && filter != "mask" {
+				return nil, fmt.Errorf("%s はプレイヤースキーマのFILTERに使用できません（reject, maskのいずれか）。\nconfig.yamlの中のPLAYER_SCHEMAを確認してください。", field.Filter)
+			}
+			if !slices.Contains(cfg.TypeValidation.Strings, field.Type) {
+				return nil, fmt.Errorf("%sのFILTERは文字列型の項目にのみ設定できます。\nconfig.yamlの中のPLAYER_SCHEMAを確認してください。", field.Name)
+			}
+		}
+		cfg.PlayerSchema[i].Filter = filter
+	}
+
+	// ログの構造化データの項目（NAME, TYPE, MIN, MAX, FILTERのみ使用）
+	seenLogTypes := make(map[int]bool)
+	for i, schema := range cfg.LogSchema {
+		if schema.Type < 1 {
+			return nil, fmt.Errorf("ログスキーマのTYPEは1以上にしてください。\nconfig.yamlの中のLOG_SCHEMAを確認してください。")
+		}
+		if seenLogTypes[schema.Type] {
+			return nil, fmt.Errorf("ログスキーマのTYPE %d が複数設定されています。\nconfig.yamlの中のLOG_SCHEMAを確認してください。", schema.Type)
+		}
+		seenLogTypes[schema.Type] = true
+		if len(cfg.LogTypes) > 0 && !seenLogTypeIds[schema.Type] {
+			return nil, fmt.Errorf("ログの種類 %d がLOG_TYPESに設定されていません。\nconfig.yamlの中のLOG_SCHEMAを確認してください。", schema.Type)
+		}
+		if len(schema.Fields) == 0 {
+			return nil, fmt.Errorf("ログスキーマのTYPE %d に項目が設定されていません。\nconfig.yamlの中のLOG_SCHEMAを確認してください。", schema.Type)
+		}
+		seenLogFields := make(map[string]bool)
+		for j, field := range schema.Fields {
+			if field.Name == "" {
+				return nil, fmt.Errorf("名前が設定されていないログスキーマの項目があります（TYPE %d）。\nconfig.yamlの中のLOG_SCHEMAを確認してください。", schema.Type)
+			}
+			if seenLogFields[field.Name] {
+				return nil, fmt.Errorf("ログスキーマ（TYPE %d）の %s が複数設定されています。\nconfig.yamlの中のLOG_SCHEMAを確認してください。", schema.Type, field.Name)
+			}
+			seenLogFields[field.Name] = true
+			if !slices.Contains(cfg.TypeValidation.Numbers, field.Type) && !slices.Contains(cfg.TypeValidation.Strings, field.Type) {
+				return nil, fmt.Errorf("%s はログスキーマのTYPEに使用できません（TYPE_VALIDATIONに含まれる型のみ）。\nconfig.yamlの中のLOG_SCHEMAを確認してください。", field.Type)
+			}
+			if field.IsIndex || field.Tag != "" || field.Merge != "" || field.IsGlobal {
+				return nil, fmt.Errorf("ログスキーマの%sにはIS_INDEX, TAG, MERGE, IS_GLOBALを設定できません。\nconfig.yamlの中のLOG_SCHEMAを確認してください。", field.Name)
+			}
+			filter := strings.ToLower(field.Filter)
+			if filter != "" {
+				if !slices.Contains([]string{"reject", "mask", "disable"}, filter) {
+					return nil, fmt.Errorf("%s はログスキーマのFILTERに使用できません（reject, mask, disableのいずれか）。\nconfig.yamlの中のLOG_SCHEMAを確認してください。", field.Filter)
+				}
+				if !slices.Contains(cfg.TypeValidation.Strings, field.Type) {
+					return nil, fmt.Errorf("%sのFILTERは文字列型の項目にのみ設定できます。\nconfig.yamlの中のLOG_SCHEMAを確認してください。", field.Name)
+				}
+			}
+			cfg.LogSchema[i].Fields[j].Filter = filter
+		}
+	}
+
 	return &cfg, nil
 }
+
+// ログの重要度（低い順）
+var logSeverities = []string{"debug", "info", "warning", "error", "critical"}
+
+// Webhookで通知できるイベント（webhookパッケージの定数と揃える）
+var webhookEvents = []string{"record.created", "record.new_top", "record.disabled", "logs.error_type"}
+
+func validateWebhook(w WebhookConfig) error {
+	if !w.Enabled {
+		return nil
+	}
+	if w.TimeoutSeconds <= 0 || w.PollIntervalSeconds <= 0 {
+		return fmt.Errorf("Webhookのタイムアウトと再送を確認する間隔は1秒以上にしてください。\nconfig.yamlの中のWEBHOOK:TIMEOUT_SECONDS, POLL_INTERVAL_SECONDSを確認してください。")
+	}
+	if w.MaxAttempts <= 0 {
+		return fmt.Errorf("Webhookの送信回数は1以上にしてください。\nconfig.yamlの中のWEBHOOK:MAX_ATTEMPTSを確認してください。")
+	}
+	if w.BackoffBaseSeconds <= 0 || w.BackoffMaxSeconds < w.BackoffBaseSeconds {
+		return fmt.Errorf("Webhookの再送の間隔は1秒以上、最大値は最初の間隔以上にしてください。\nconfig.yamlの中のWEBHOOK:BACKOFF_BASE_SECONDS, BACKOFF_MAX_SECONDSを確認してください。")
+	}
+	seen := make(map[string]bool)
+	for _, ep := range w.Endpoints {
+		if ep.Name == "" || seen[ep.Name] {
+			return fmt.Errorf("Webhookの送信先には重複しない名前を設定してください。\nconfig.yamlの中のWEBHOOK:ENDPOINTSのNAMEを確認してください。")
+		}
+		seen[ep.Name] = true
+		if !strings.HasPrefix(ep.URL, "http://") && !strings.HasPrefix(ep.URL, "https://") {
+			return fmt.Errorf("Webhook %s のURLはhttp://またはhttps://で始めてください。\nconfig.yamlの中のWEBHOOK:ENDPOINTSのURLを確認してください。", ep.Name)
+		}
+		if ep.Secret == "" {
+			return fmt.Errorf("Webhook %s の署名に使う秘密鍵を設定してください。\nconfig.yamlの中のWEBHOOK:ENDPOINTSのSECRETを確認してください。", ep.Name)
+		}
+		if len(ep.Events) == 0 {
+			return fmt.Errorf("Webhook %s で通知するイベントを設定してください。\nconfig.yamlの中のWEBHOOK:ENDPOINTSのEVENTSを確認してください。", ep.Name)
+		}
+		for _, event := range ep.Events {
+			if !slices.Contains(webhookEvents, event) {
+				return fmt.Errorf("%s はWebhookのイベントに使用できません（%sのいずれか）。\nconfig.yamlの中のWEBHOOK:ENDPOINTSのEVENTSを確認してください。", event, strings.Join(webhookEvents, ", "))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"ranklogger/config"
+)
+
+const backupPrefix = "game_data-"
+
+// バックアップファイルの情報
+type BackupFile struct {
+	Name      string    `json:"name"`
+	SizeBytes int64     `json:"size_bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Backup: 稼働中のDBから一貫性のあるスナップショットを作成する
+// VACUUM INTO はWALの内容も含めた時点のDBを新しいファイルに書き出すため、ファイルを直接コピーするより安全
+func Backup(ctx context.Context, db *sql.DB, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	// 定期バックアップとPOST /backupsが同じ秒に重ならないように、ナノ秒まで名前に入れる
+	now := time.Now()
+	path := filepath.Join(dir, fmt.Sprintf("%s%s-%09d.db", backupPrefix, now.Format("20060102-150405"), now.Nanosecond()))
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("backup already exists: %s", path)
+	}
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// OpenReadOnly: DBを読み取り専用で開く（CLIのbackupのように、稼働中のDBにマイグレーションなどを実行しない場合に使う）
+func OpenReadOnly(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return sql.Open("sqlite3", "file:"+path+"?mode=ro")
+}
+
+// ListBackups: バックアップを新しい順に返す
+func ListBackups(dir string) ([]BackupFile, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []BackupFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []BackupFile{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), backupPrefix) || !strings.HasSuffix(e.Name(), ".db") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, BackupFile{Name: e.Name(), SizeBytes: info.Size(), CreatedAt: info.ModTime()})
+	}
+	// ファイル名に日時が入っているので、名前の降順＝新しい順
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name > backups[j].Name })
+	return backups, nil
+}
+
+// RotateBackups: 新しいものからkeep個を残して古いバックアップを削除する
+func RotateBackups(dir string, keep int) (int, error) {
+	if keep <= 0 {
+		return 0, nil
+	}
+	backups, err := ListBackups(dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, b := range backups[min(keep, len(backups)):] {
+		if err := os.Remove(filepath.Join(dir, b.Name)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// 定期バックアップ（メンテナンス処理から呼ばれる）
+func (m *Maintenance) backup(ctx context.Context) (int64, string, error) {
+	path, err := Backup(ctx, m.db, m.cfg.Backup.Dir)
+	if err != nil {
+		return 0, "", err
+	}
+	removed, err := RotateBackups(m.cfg.Backup.Dir, m.cfg.Backup.Keep)
+	return 1, fmt.Sprintf("%s (rotated %d)", filepath.Base(path), removed), err
+}
+
+// ValidateSnapshot: スナップショットが壊れておらず、現在の設定（RECORD_SCHEMA, ENABLE_PLAY_COUNT）と一致するかを確認する
+func ValidateSnapshot(path string, cfg *config.Config) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	snap, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	ctx := context.Background()
+
+	var integrity string
+	if err := snap.QueryRowContext(ctx, "PRAGMA integrity_check").Scan(&integrity); err != nil {
+		return fmt.Errorf("not a valid database: %v", err)
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("integrity check failed: %s", integrity)
+	}
+
+	columns := func(table string) (map[string]bool, error) {
+		rows, err := snap.QueryContext(ctx, "SELECT name FROM pragma_table_xinfo(?)", table)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		cols := make(map[string]bool)
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return nil, err
+			}
+			cols[name] = true
+		}
+		if len(cols) == 0 {
+			return nil, fmt.Errorf("table %s not found", table)
+		}
+		return cols, rows.Err()
+	}
+
+	sessionCols, err := columns("sessions")
+	if err != nil {
+		return err
+	}
+	if _, err := columns("logs"); err != nil {
+		return err
+	}
+
+	required := []string{"id", "uuid", "ip_address", "data", "disable", "created_at"}
+	if cfg.Server.EnablePlayCount {
+		required = append(required, "play_count")
+	} else if sessionCols["play_count"] {
+		return fmt.Errorf("snapshot has play_count but SERVER:ENABLE_PLAY_COUNT is false")
+	}
+	for _, field := range cfg.Schema {
+		if !field.IsIndex {
+			continue
+		}
+		if field.Tag != "" {
+			required = append(required, field.Tag+"_"+field.Name)
+		} else {
+			required = append(required, field.Name)
+		}
+	}
+
+	var missing []string
+	for _, col := range required {
+		if !sessionCols[col] {
+			missing = append(missing, col)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("snapshot does not match RECORD_SCHEMA, missing columns: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Restore: スナップショットを検証してから、現在のDBファイルと入れ替える
+// サーバーを停止した状態で実行すること（DBを開いているプロセスがあれば中止する）。元のDBは {DB_PATH}.before-restore-{日時} として残す
+func Restore(cfg *config.Config, src string) (string, error) {
+	if err := ValidateSnapshot(src, cfg); err != nil {
+		return "", err
+	}
+	dst := cfg.Server.DBPath
+
+	// 1. 入れ替え先と同じディレクトリに一時ファイルとしてコピー（renameを原子的にするため）
+	tmp := dst + ".restore-tmp"
+	if err := copyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	// 2. 現在のDBをWALごと退避（退避し終えるまで排他ロックを取り、他のプロセスが使っている場合は中止する）
+	var saved string
+	if _, err := os.Stat(dst); err == nil {
+		unlock, err := lockForRestore(dst)
+		if err != nil {
+			os.Remove(tmp)
+			return "", fmt.Errorf("lock current database failed (is the server still running?): %v", err)
+		}
+		saved = dst + ".before-restore-" + time.Now().Format("20060102-150405")
+		err = os.Rename(dst, saved)
+		unlock()
+		if err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+	}
+	os.Remove(dst + "-wal")
+	os.Remove(dst + "-shm")
+
+	// 3. 入れ替え
+	if err := os.Rename(tmp, dst); err != nil {
+		return saved, err
+	}
+	return saved, nil
+}
+
+// lockForRestore: DBの排他ロックを取り、WALの内容をDB本体に書き戻してWALファイルを空にする
+// locking_modeをEXCLUSIVEにすると、ロックは返した関数で接続を閉じるまで保持される
+// サーバーなど他のプロセスが開いている場合はロックを取れないため、エラーを返す
+func lockForRestore(path string) (func(), error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// PRAGMAとロックは接続ごとのため、1つの接続だけを使う
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range []string{"PRAGMA busy_timeout = 0", "PRAGMA locking_mode = EXCLUSIVE", "BEGIN EXCLUSIVE", "COMMIT"} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("database is in use: %v", err)
+		}
+	}
+	var busy, logFrames, checkpointed int
+	if err := db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if busy != 0 {
+		db.Close()
+		return nil, fmt.Errorf("database is busy")
+	}
+	return func() { db.Close() }, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
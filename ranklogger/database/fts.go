@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// ログの全文検索（FTS5）
+// logs_ftsはlogsのcontentを参照する索引で、logsへの追加・更新・削除はトリガーで反映する
+// （POST /logs、インポート、保持期間による削除のどれでも索引がずれない）
+// FTS5はビルドタグ sqlite_fts5 を付けてビルドした場合のみ使える。付けていない場合は検索だけが使えなくなる
+
+// 索引を同期するトリガー
+var logSearchTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS logs_fts_ai AFTER INSERT ON logs BEGIN
+		INSERT INTO logs_fts (rowid, content) VALUES (new.id, new.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS logs_fts_ad AFTER DELETE ON logs BEGIN
+		INSERT INTO logs_fts (logs_fts, rowid, content) VALUES ('delete', old.id, old.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS logs_fts_au AFTER UPDATE OF content ON logs BEGIN
+		INSERT INTO logs_fts (logs_fts, rowid, content) VALUES ('delete', old.id, old.content);
+		INSERT INTO logs_fts (rowid, content) VALUES (new.id, new.content);
+	END`,
+}
+
+// setupLogSearch: 全文検索の索引とトリガーを作成する
+// トリガーがなかった場合（新規作成、またはFTS5なしで起動していた間）は、索引をlogsから作り直す
+func setupLogSearch(db *sql.DB) error {
+	if !fts5Available(db) {
+		// FTS5なしではトリガーの実行が失敗し、ログを登録できなくなるため削除しておく
+		for _, name := range []string{"logs_fts_ai", "logs_fts_ad", "logs_fts_au"} {
+			if _, err := db.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+				return err
+			}
+		}
+		log.Printf("Full-text log search is disabled (build with -tags sqlite_fts5 to enable)")
+		return nil
+	}
+
+	// trigramはスペースで区切らない日本語や、NullReferenceExceptionのような識別子の一部でも検索できる
+	createLogSearch := `
+	CREATE VIRTUAL TABLE IF NOT EXISTS logs_fts USING fts5(
+		content,
+		content = 'logs',
+		content_rowid = 'id',
+		tokenize = 'trigram'
+	);`
+	if _, err := db.Exec(createLogSearch); err != nil {
+		return err
+	}
+
+	var synced bool
+	if err := db.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'trigger' AND name = 'logs_fts_ai'").Scan(&synced); err != nil {
+		return err
+	}
+	for _, trigger := range logSearchTriggers {
+		if _, err := db.Exec(trigger); err != nil {
+			return err
+		}
+	}
+	if !synced {
+		if _, err := db.Exec("INSERT INTO logs_fts (logs_fts) VALUES ('rebuild')"); err != nil {
+			return err
+		}
+		log.Printf("Full-text log search index rebuilt")
+	}
+	return nil
+}
+
+// fts5Available: FTS5を含めてビルドされているか
+func fts5Available(db *sql.DB) bool {
+	var used bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&used); err != nil {
+		return false
+	}
+	return used
+}
+
+// LogSearchAvailable: ログの全文検索が使えるか（索引と同期用のトリガーがあるか）
+func LogSearchAvailable(ctx context.Context, db *sql.DB) bool {
+	var ok bool
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'trigger' AND name = 'logs_fts_ai'").Scan(&ok)
+	return err == nil && ok
+}
@@ -0,0 +1,262 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"ranklogger/config"
+)
+
+// メンテナンス処理1回分の結果（/metricsで表示する）
+type TaskResult struct {
+	LastRun    time.Time `json:"last_run"`
+	DurationMs float64   `json:"duration_ms"`
+	Rows       int64     `json:"rows"`
+	Detail     string    `json:"detail,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Runs       int       `json:"runs"`
+}
+
+type maintenanceTask struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) (rows int64, detail string, err error)
+}
+
+// Maintenance: ログの削除やVACUUMなどを設定された間隔で実行するスケジューラー
+type Maintenance struct {
+	db     *sql.DB
+	cfg    *config.Config
+	mu     sync.Mutex
+	result map[string]TaskResult
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// StartMaintenance: バックグラウンドでメンテナンス処理を開始する
+// 各処理は起動直後に1回実行され、その後は設定された間隔で実行される（間隔が0の処理は実行しない）
+func StartMaintenance(db *sql.DB, cfg *config.Config) *Maintenance {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Maintenance{
+		db:     db,
+		cfg:    cfg,
+		result: make(map[string]TaskResult),
+		cancel: cancel,
+	}
+	if !cfg.Maintenance.Enabled {
+		return m
+	}
+
+	mcfg := cfg.Maintenance
+	tasks := []maintenanceTask{
+		{"log_cleanup", minutes(mcfg.LogCleanupIntervalMinutes), m.cleanupLogs},
+		{"incremental_vacuum", minutes(mcfg.VacuumIntervalMinutes), m.incrementalVacuum},
+		{"wal_checkpoint", minutes(mcfg.CheckpointIntervalMinutes), m.checkpoint},
+		{"optimize", minutes(mcfg.OptimizeIntervalMinutes), m.optimize},
+	}
+	if cfg.Backup.IntervalMinutes > 0 {
+		tasks = append(tasks, maintenanceTask{"backup", minutes(cfg.Backup.IntervalMinutes), m.backup})
+	}
+	if mcfg.StaleSessionDays > 0 {
+		tasks = append(tasks, maintenanceTask{"session_prune", minutes(mcfg.SessionPruneIntervalMinutes), m.pruneStaleSessions})
+	}
+	if cfg.Idempotency.Enabled {
+		tasks = append(tasks, maintenanceTask{"idempotency_cleanup", minutes(mcfg.IdempotencyCleanupIntervalMinutes), m.cleanupIdempotencyKeys})
+	}
+	if cfg.Webhook.RetentionDays > 0 {
+		tasks = append(tasks, maintenanceTask{"webhook_cleanup", minutes(mcfg.WebhookCleanupIntervalMinutes), m.cleanupWebhookDeliveries})
+	}
+	if cfg.Retention.DisabledSessionDays > 0 || cfg.Retention.UnrankedSessionDays > 0 {
+		tasks = append(tasks, maintenanceTask{"session_retention", minutes(mcfg.SessionPruneIntervalMinutes), m.cleanupSessions})
+	}
+
+	for _, task := range tasks {
+		if task.interval <= 0 {
+			continue
+		}
+		m.wg.Add(1)
+		go m.loop(ctx, task)
+	}
+	return m
+}
+
+func minutes(n int) time.Duration {
+	return time.Duration(n) * time.Minute
+}
+
+func (m *Maintenance) loop(ctx context.Context, task maintenanceTask) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(task.interval)
+	defer ticker.Stop()
+	for {
+		m.runTask(ctx, task)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Maintenance) runTask(ctx context.Context, task maintenanceTask) {
+	start := time.Now()
+	rows, detail, err := task.run(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.result[task.name]
+	r.LastRun = start
+	r.DurationMs = float64(time.Since(start).Microseconds()) / 1000.0
+	r.Rows = rows
+	r.Detail = detail
+	r.Error = ""
+	r.Runs++
+	if err != nil && ctx.Err() == nil {
+		r.Error = err.Error()
+		log.Printf("Maintenance %s failed: %v", task.name, err)
+	} else if rows > 0 {
+		log.Printf("Maintenance %s: %d rows (%s)", task.name, rows, detail)
+	}
+	m.result[task.name] = r
+}
+
+// Stop: 実行中の処理の区切り（バッチ単位）まで待ってから停止する
+func (m *Maintenance) Stop() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// Results: 各処理の直近の実行結果
+func (m *Maintenance) Results() map[string]TaskResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	results := make(map[string]TaskResult, len(m.result))
+	for name, r := range m.result {
+		results[name] = r
+	}
+	return results
+}
+
+// 1件も削除されなくなるまで、バッチ単位でDELETEを繰り返す
+// queryの最後のプレースホルダーにはバッチサイズが入る
+func deleteInBatches(ctx context.Context, db *sql.DB, query string, args ...interface{}) (int64, error) {
+	var total int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		result, err := db.ExecContext(ctx, query, args...)
+		if err != nil {
+			return total, err
+		}
+		n, _ := result.RowsAffected()
+		total += n
+		if n == 0 {
+			return total, nil
+		}
+	}
+}
+
+// 空きページをファイルから解放する（auto_vacuum = INCREMENTAL のDBでのみ有効）
+func (m *Maintenance) incrementalVacuum(ctx context.Context) (int64, string, error) {
+	var autoVacuum int
+	if err := m.db.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&autoVacuum); err != nil {
+		return 0, "", err
+	}
+	if autoVacuum != 2 {
+		return 0, "auto_vacuum is not INCREMENTAL (run VACUUM once to enable)", nil
+	}
+
+	var before, after int64
+	if err := m.db.QueryRowContext(ctx, "PRAGMA freelist_count").Scan(&before); err != nil {
+		return 0, "", err
+	}
+
+	// incremental_vacuumは1ページごとに1行返すため、最後まで読み進める必要がある
+	rows, err := m.db.QueryContext(ctx, fmt.Sprintf("PRAGMA incremental_vacuum(%d)", m.cfg.Maintenance.VacuumPages))
+	if err != nil {
+		return 0, "", err
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, "", err
+	}
+
+	if err := m.db.QueryRowContext(ctx, "PRAGMA freelist_count").Scan(&after); err != nil {
+		return 0, "", err
+	}
+	return before - after, fmt.Sprintf("free pages %d -> %d", before, after), nil
+}
+
+// WALの内容をDB本体に書き戻し、WALファイルを切り詰める
+func (m *Maintenance) checkpoint(ctx context.Context) (int64, string, error) {
+	var busy, logFrames, checkpointed int64
+	err := m.db.QueryRowContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed)
+	if err != nil {
+		return 0, "", err
+	}
+	detail := fmt.Sprintf("log %d frames, checkpointed %d frames", logFrames, checkpointed)
+	if busy != 0 {
+		detail += " (busy)"
+	}
+	return checkpointed, detail, nil
+}
+
+// クエリプランナー用の統計情報を更新する
+func (m *Maintenance) optimize(ctx context.Context) (int64, string, error) {
+	_, err := m.db.ExecContext(ctx, "PRAGMA optimize")
+	return 0, "", err
+}
+
+// レコードもログも持たないまま放置されたセッションを削除する
+func (m *Maintenance) pruneStaleSessions(ctx context.Context) (int64, string, error) {
+	days := m.cfg.Maintenance.StaleSessionDays
+	total, err := deleteInBatches(ctx, m.db,
+		`DELETE FROM sessions WHERE id IN (
+			SELECT s.id FROM sessions s
+			WHERE s.created_at < datetime('now', 'localtime', ?)
+				AND json(s.data) = '{}'
+				AND NOT EXISTS (SELECT 1 FROM logs l WHERE l.session_id = s.id)
+				AND NOT EXISTS (SELECT 1 FROM record_submissions r WHERE r.session_id = s.id)
+			LIMIT ?
+		)`,
+		fmt.Sprintf("-%d days", days), m.cfg.Maintenance.DeleteBatchSize)
+	return total, fmt.Sprintf("empty sessions older than %d days", days), err
+}
+
+// 保持期間（IDEMPOTENCY:WINDOW_HOURS）を過ぎたIdempotency-Keyを削除する
+func (m *Maintenance) cleanupIdempotencyKeys(ctx context.Context) (int64, string, error) {
+	hours := m.cfg.Idempotency.WindowHours
+	total, err := deleteInBatches(ctx, m.db,
+		`DELETE FROM idempotency_keys WHERE key IN (
+			SELECT key FROM idempotency_keys
+			WHERE created_at < datetime('now', 'localtime', ?)
+			LIMIT ?
+		)`,
+		fmt.Sprintf("-%d hours", hours), m.cfg.Maintenance.DeleteBatchSize)
+	return total, fmt.Sprintf("keys older than %d hours", hours), err
+}
+
+// 保持期間（WEBHOOK:RETENTION_DAYS）を過ぎた、送信済み・失敗したWebhookを試行履歴ごと削除する
+func (m *Maintenance) cleanupWebhookDeliveries(ctx context.Context) (int64, string, error) {
+	days := fmt.Sprintf("-%d days", m.cfg.Webhook.RetentionDays)
+	expired := `SELECT id FROM webhook_deliveries
+		WHERE status IN ('delivered', 'failed') AND created_at < datetime('now', 'localtime', ?)
+		LIMIT ?`
+	if _, err := deleteInBatches(ctx, m.db,
+		"DELETE FROM webhook_attempts WHERE delivery_id IN ("+expired+")",
+		days, m.cfg.Maintenance.DeleteBatchSize); err != nil {
+		return 0, "", err
+	}
+	total, err := deleteInBatches(ctx, m.db,
+		"DELETE FROM webhook_deliveries WHERE id IN ("+expired+")",
+		days, m.cfg.Maintenance.DeleteBatchSize)
+	return total, fmt.Sprintf("deliveries older than %d days", m.cfg.Webhook.RetentionDays), err
+}
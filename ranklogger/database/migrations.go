@@ -0,0 +1,283 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+
+	"ranklogger/config"
+)
+
+// 一度だけ実行すればよいスキーマ変更・データ移行
+// 追加するときは末尾に足していく（名前は変更しない）
+type migration struct {
+	name string
+	up   func(ctx context.Context, tx *sql.Tx, cfg *config.Config) error
+}
+
+var migrations = []migration{
+	{
+		// GetLogsはsession_idで絞り込むため、インデックスを張る
+		name: "0001_index_logs_session_id",
+		up: func(ctx context.Context, tx *sql.Tx, cfg *config.Config) error {
+			_, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS idx_logs_session_id ON logs(session_id)")
+			return err
+		},
+	},
+	{
+		// クライアントでプレイした日時（オフラインでプレイした結果を後から送る場合、created_atとは異なる）
+		name: "0002_sessions_played_at",
+		up: func(ctx context.Context, tx *sql.Tx, cfg *config.Config) error {
+			_, err := tx.ExecContext(ctx, "ALTER TABLE sessions ADD COLUMN played_at DATETIME")
+			return err
+		},
+	},
+	{
+		// 以前は登録時にHTMLエスケープしていたため、保存されている文字列を元に戻す（エスケープは出力時に行う）
+		name: "0003_unescape_html",
+		up: func(ctx context.Context, tx *sql.Tx, cfg *config.Config) error {
+			for _, col := range []struct{ table, column string }{
+				{"sessions", "data"},
+				{"players", "data"},
+				{"record_submissions", "payload"},
+				{"record_submissions", "result"},
+			} {
+				if err := unescapeJSONColumn(ctx, tx, col.table, col.column); err != nil {
+					return err
+				}
+			}
+			for _, col := range []struct{ table, column string }{
+				{"logs", "content"},
+				{"players", "display_name"},
+			} {
+				if err := unescapeTextColumn(ctx, tx, col.table, col.column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// ログの構造化データ（LOG_SCHEMA）をJSONBで保存する。集計は種類ごとに行うため、typeのインデックスも張る
+		name: "0004_logs_data",
+		up: func(ctx context.Context, tx *sql.Tx, cfg *config.Config) error {
+			if _, err := tx.ExecContext(ctx, "ALTER TABLE logs ADD COLUMN data BLOB"); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS idx_logs_type_created_at ON logs(type, created_at)")
+			return err
+		},
+	},
+}
+
+// エスケープされた文字（&lt; など）を含む行だけを対象に、JSONの文字列の値を元に戻す
+func unescapeJSONColumn(ctx context.Context, tx *sql.Tx, table, column string) error {
+	rows, err := tx.QueryContext(ctx,
+		fmt.Sprintf("SELECT rowid, json(%s) FROM %s WHERE json(%s) LIKE '%%&%%'", column, table, column))
+	if err != nil {
+		return err
+	}
+	updates := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var raw string
+		if err := rows.Scan(&id, &raw); err != nil {
+			rows.Close()
+			return err
+		}
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &data); err != nil {
+			rows.Close()
+			return err
+		}
+		changed := false
+		for k, v := range data {
+			if str, ok := v.(string); ok {
+				if unescaped := html.UnescapeString(str); unescaped != str {
+					data[k] = unescaped
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			continue
+		}
+		b, err := json.Marshal(data)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		updates[id] = string(b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// 読み取りが終わってから書き戻す
+	for id, data := range updates {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s = jsonb(?) WHERE rowid = ?", table, column), data, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// エスケープされた文字を含む行だけを対象に、文字列の列を元に戻す
+func unescapeTextColumn(ctx context.Context, tx *sql.Tx, table, column string) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT rowid, %s FROM %s WHERE %s LIKE '%%&%%'", column, table, column))
+	if err != nil {
+		return err
+	}
+	updates := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var text string
+		if err := rows.Scan(&id, &text); err != nil {
+			rows.Close()
+			return err
+		}
+		if unescaped := html.UnescapeString(text); unescaped != text {
+			updates[id] = unescaped
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, text := range updates {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ?", table, column), text, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 未適用のマイグレーションを順番に実行する（InitDBから呼ばれる）
+func applyMigrations(db *sql.DB, cfg *config.Config) error {
+	ctx := context.Background()
+	createTable := `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at DATETIME DEFAULT (datetime('now', 'localtime'))
+	);`
+	if _, err := db.ExecContext(ctx, createTable); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		var exists int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM schema_migrations WHERE name = ?", m.name).Scan(&exists); err != nil {
+			return err
+		}
+		if exists > 0 {
+			continue
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := m.up(ctx, tx, cfg); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s failed: %v", m.name, err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (name) VALUES (?)", m.name); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Applied migration: %s", m.name)
+	}
+	return nil
+}
+
+// PendingMigrations: まだ適用されていないマイグレーションの名前を返す
+func PendingMigrations(ctx context.Context, db *sql.DB) ([]string, error) {
+	applied := make(map[string]bool)
+	rows, err := db.QueryContext(ctx, "SELECT name FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		applied[name] = true
+	}
+
+	var pending []string
+	for _, m := range migrations {
+		if !applied[m.name] {
+			pending = append(pending, m.name)
+		}
+	}
+	return pending, rows.Err()
+}
+
+// MissingColumns: RECORD_SCHEMAで定義された仮想列のうち、テーブルに存在しないものを返す
+func MissingColumns(ctx context.Context, db *sql.DB, cfg *config.Config) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM pragma_table_xinfo('sessions')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		existing[name] = true
+	}
+
+	var missing []string
+	for _, field := range cfg.Schema {
+		if !field.IsIndex {
+			continue
+		}
+		name := field.Name
+		if field.Tag != "" {
+			name = field.Tag + "_" + field.Name
+		}
+		if !existing[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing, rows.Err()
+}
+
+// SchemaHash: テーブル・インデックス定義全体のハッシュ（環境間でスキーマが一致しているかの確認用）
+func SchemaHash(ctx context.Context, db *sql.DB) (string, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT sql FROM sqlite_master WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%' ORDER BY type, name")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	h := sha256.New()
+	for rows.Next() {
+		var ddl string
+		if err := rows.Scan(&ddl); err != nil {
+			return "", err
+		}
+		h.Write([]byte(ddl))
+		h.Write([]byte{0})
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,341 @@
+package database
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 削除前の行を圧縮NDJSONとして書き出す（RETENTION:ARCHIVEが有効な場合のみ）
+// ファイルは1回の実行ごとに {DIR}/{テーブル名}-{タスク名}-{日時}-{ナノ秒}.ndjson.gz として作られる
+// （ログの削除とセッションの削除は同時に動くため、タスク名とナノ秒で名前が重ならないようにする）
+type archiver struct {
+	path string
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+}
+
+func (m *Maintenance) newArchiver(table, task string, start time.Time) *archiver {
+	if !m.cfg.Retention.Archive.Enabled {
+		return nil
+	}
+	name := fmt.Sprintf("%s-%s-%s-%09d.ndjson.gz", table, task, start.Format("20060102-150405"), start.Nanosecond())
+	return &archiver{path: filepath.Join(m.cfg.Retention.Archive.Dir, name)}
+}
+
+// 書き出す行があるときだけファイルを作る
+func (a *archiver) open() error {
+	if a.file != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o755); err != nil {
+		return err
+	}
+	// 既存のファイルに別のgzipストリームを書き足さないよう、新しく作れない場合はエラーにする
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	a.file = f
+	a.gz = gzip.NewWriter(f)
+	a.enc = json.NewEncoder(a.gz)
+	return nil
+}
+
+func (a *archiver) write(row map[string]interface{}) error {
+	if a == nil {
+		return nil
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	return a.enc.Encode(row)
+}
+
+// 削除をコミットする前に、書き出した内容をディスクに反映させる
+func (a *archiver) sync() error {
+	if a == nil || a.file == nil {
+		return nil
+	}
+	if err := a.gz.Flush(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *archiver) Close() error {
+	if a == nil || a.file == nil {
+		return nil
+	}
+	if err := a.gz.Close(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// 行を列名をキーにしたmapとして読み取る
+func scanRowMaps(rows *sql.Rows) ([]map[string]interface{}, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var results []map[string]interface{}
+	for rows.Next() {
+		columns := make([]interface{}, len(cols))
+		columnPointers := make([]interface{}, len(cols))
+		for i := range columns {
+			columnPointers[i] = &columns[i]
+		}
+		if err := rows.Scan(columnPointers...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(cols))
+		for i, name := range cols {
+			if b, ok := columns[i].([]byte); ok {
+				row[name] = string(b)
+			} else {
+				row[name] = columns[i]
+			}
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+const archivedLogColumns = "id, session_id, type, content, created_at"
+
+// whereに一致するログをバッチ単位でアーカイブ・削除する
+func (m *Maintenance) deleteLogs(ctx context.Context, arc *archiver, where string, args ...interface{}) (int64, error) {
+	var total int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		n, err := m.deleteLogBatch(ctx, arc, where, args)
+		total += n
+		if err != nil || n == 0 {
+			return total, err
+		}
+	}
+}
+
+func (m *Maintenance) deleteLogBatch(ctx context.Context, arc *archiver, where string, args []interface{}) (int64, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("SELECT %s FROM logs WHERE %s LIMIT ?", archivedLogColumns, where)
+	rows, err := tx.QueryContext(ctx, query, append(args, m.cfg.Maintenance.DeleteBatchSize)...)
+	if err != nil {
+		return 0, err
+	}
+	logs, err := scanRowMaps(rows)
+	rows.Close()
+	if err != nil || len(logs) == 0 {
+		return 0, err
+	}
+
+	ids := make([]interface{}, len(logs))
+	for i, l := range logs {
+		ids[i] = l["id"]
+		if err := arc.write(l); err != nil {
+			return 0, err
+		}
+	}
+	if err := arc.sync(); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM logs WHERE id IN (%s)", placeholders(len(ids))), ids...)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+	return n, nil
+}
+
+// ログの保持期間に従った削除
+// RETENTION:TYPE_RULESに定義された種類はその日数で、それ以外はLOG_RETENTION_DAYSで削除する
+func (m *Maintenance) cleanupLogs(ctx context.Context) (int64, string, error) {
+	start := time.Now()
+	arc := m.newArchiver("logs", "log_cleanup", start)
+	defer arc.Close()
+
+	var total int64
+	var details []string
+	var ruleTypes []interface{}
+
+	for _, rule := range m.cfg.Retention.TypeRules {
+		ruleTypes = append(ruleTypes, rule.Type)
+		if rule.Days <= 0 {
+			continue // この種類は無期限保持
+		}
+		n, err := m.deleteLogs(ctx, arc,
+			"type = ? AND created_at < datetime('now', 'localtime', ?)",
+			rule.Type, fmt.Sprintf("-%d days", rule.Days))
+		total += n
+		details = append(details, fmt.Sprintf("type %d: %d", rule.Type, n))
+		if err != nil {
+			return total, strings.Join(details, ", "), err
+		}
+	}
+
+	if days := m.cfg.Retention.LogRetentionDays; days > 0 {
+		where := "created_at < datetime('now', 'localtime', ?)"
+		args := []interface{}{fmt.Sprintf("-%d days", days)}
+		if len(ruleTypes) > 0 {
+			where += fmt.Sprintf(" AND type NOT IN (%s)", placeholders(len(ruleTypes)))
+			args = append(args, ruleTypes...)
+		}
+		n, err := m.deleteLogs(ctx, arc, where, args...)
+		total += n
+		details = append(details, fmt.Sprintf("default: %d", n))
+		if err != nil {
+			return total, strings.Join(details, ", "), err
+		}
+	}
+
+	if len(details) == 0 {
+		return 0, "retention disabled", nil // 0以下の場合は削除しない設定
+	}
+	return total, strings.Join(details, ", "), nil
+}
+
+// セッションの保持期間に従った削除（セッションに紐づくログも一緒に削除する）
+// 無効化されたセッションと、レコードが登録されていない（ランキングに載らない）セッションが対象
+func (m *Maintenance) cleanupSessions(ctx context.Context) (int64, string, error) {
+	start := time.Now()
+	sessionArc := m.newArchiver("sessions", "session_retention", start)
+	defer sessionArc.Close()
+	logArc := m.newArchiver("logs", "session_retention", start)
+	defer logArc.Close()
+
+	var total int64
+	var details []string
+	policies := []struct {
+		name  string
+		days  int
+		where string
+	}{
+		{"disabled", m.cfg.Retention.DisabledSessionDays, "disable = TRUE"},
+		{"unranked", m.cfg.Retention.UnrankedSessionDays, "json(data) = '{}'"},
+	}
+	for _, p := range policies {
+		if p.days <= 0 {
+			continue
+		}
+		var n int64
+		for {
+			if err := ctx.Err(); err != nil {
+				return total, strings.Join(details, ", "), err
+			}
+			deleted, err := m.deleteSessionBatch(ctx, sessionArc, logArc,
+				p.where+" AND created_at < datetime('now', 'localtime', ?)",
+				fmt.Sprintf("-%d days", p.days))
+			n += deleted
+			if err != nil {
+				return total + n, strings.Join(details, ", "), err
+			}
+			if deleted == 0 {
+				break
+			}
+		}
+		total += n
+		details = append(details, fmt.Sprintf("%s: %d", p.name, n))
+	}
+	return total, strings.Join(details, ", "), nil
+}
+
+func (m *Maintenance) deleteSessionBatch(ctx context.Context, sessionArc, logArc *archiver, where string, args ...interface{}) (int64, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(
+		"SELECT id, uuid, ip_address, json(data) AS data, disable, created_at, played_at FROM sessions WHERE %s LIMIT ?", where)
+	if m.cfg.Server.EnablePlayCount {
+		query = strings.Replace(query, "uuid,", "uuid, play_count,", 1)
+	}
+	rows, err := tx.QueryContext(ctx, query, append(args, m.cfg.Maintenance.DeleteBatchSize)...)
+	if err != nil {
+		return 0, err
+	}
+	sessions, err := scanRowMaps(rows)
+	rows.Close()
+	if err != nil || len(sessions) == 0 {
+		return 0, err
+	}
+
+	ids := make([]interface{}, len(sessions))
+	for i, s := range sessions {
+		ids[i] = s["id"]
+		// dataはJSON文字列のままではなくオブジェクトとして書き出す
+		if str, ok := s["data"].(string); ok {
+			s["data"] = json.RawMessage(str)
+		}
+		if err := sessionArc.write(s); err != nil {
+			return 0, err
+		}
+	}
+	in := placeholders(len(ids))
+
+	// 紐づくログを先にアーカイブ・削除する
+	if logArc != nil {
+		rows, err := tx.QueryContext(ctx,
+			fmt.Sprintf("SELECT %s FROM logs WHERE session_id IN (%s)", archivedLogColumns, in), ids...)
+		if err != nil {
+			return 0, err
+		}
+		logs, err := scanRowMaps(rows)
+		rows.Close()
+		if err != nil {
+			return 0, err
+		}
+		for _, l := range logs {
+			if err := logArc.write(l); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := sessionArc.sync(); err != nil {
+		return 0, err
+	}
+	if err := logArc.sync(); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM logs WHERE session_id IN (%s)", in), ids...); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM record_submissions WHERE session_id IN (%s)", in), ids...); err != nil {
+		return 0, err
+	}
+	result, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM sessions WHERE id IN (%s)", in), ids...)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+	return n, nil
+}
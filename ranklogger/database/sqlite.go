@@ -1,21 +1,53 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"log"
+	"strings"
+
+	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/otel/attribute"
 
 	"ranklogger/config"
+	"ranklogger/tracing"
 
 	_ "github.com/mattn/go-sqlite3" // SQLiteドライバー
 )
 
 func InitDB(cfg *config.Config) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", cfg.Server.DBPath)
+	// SQLの実行をOpenTelemetryのスパンとして記録するラッパー経由で開く
+	// リクエストのスパンを持つコンテキストで実行されたSQLだけを記録する（トレース無効時は何もしない）
+	// _txlock=immediate: トランザクション開始時に書き込みロックを取る
+	// 読み取りから書き込みへの昇格で即座に "database is locked" になるのを防ぎ、busy_timeoutの間待つようにする
+	// （ハンドラーとメンテナンス処理が同時に書き込むため）
+	dsn := cfg.Server.DBPath
+	if strings.Contains(dsn, "?") {
+		dsn += "&_txlock=immediate"
+	} else {
+		dsn += "?_txlock=immediate"
+	}
+	db, err := otelsql.Open("sqlite3", dsn,
+		otelsql.WithAttributes(attribute.String("db.system.name", "sqlite")),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return tracing.HasSpan(ctx)
+			},
+		}),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("%v file path: %v", err, cfg.Server.DBPath)
 	}
 
+	// auto_vacuumをINCREMENTALにすると、データベース全体ではなく削除したテーブルだけ（logsテーブルだけ）再構築される
+	// DBファイルに何か書き込まれた後（WALモードへの切り替えを含む）では変更できないため、最初に設定する
+	// 実際の領域の解放はメンテナンス処理の PRAGMA incremental_vacuum で行う
+	_, _ = db.Exec("PRAGMA auto_vacuum = INCREMENTAL;")
+
 	// WALモードを有効化
 	_, err = db.Exec("PRAGMA journal_mode=WAL;")
 	if err != nil {
@@ -26,9 +58,6 @@ func InitDB(cfg *config.Config) (*sql.DB, error) {
 	// NORMAL にすると、WALモード時に十分な安全性と高いパフォーマンスを両立できる
 	_, _ = db.Exec("PRAGMA synchronous=NORMAL;")
 
-	// auto_vacuumをINCREMENTALにすると、データベース全体ではなく削除したテーブルだけ（logsテーブルだけ）再構築される
-	_, _ = db.Exec("PRAGMA auto_vacuum = INCREMENTAL;")
-
 	var playCountAddText = [2]string{}
 	// 1. セッションテーブルの作成
 	if cfg.Server.EnablePlayCount {
@@ -80,6 +109,145 @@ func InitDB(cfg *config.Config) (*sql.DB, error) {
 		return nil, err
 	}
 
+	// 4. 再送されたリクエストの判定用（Idempotency-Key）
+	// status = 0 は処理中。レスポンスを保存した後は、そのステータスコードになる
+	createIdempotencyTable := `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key TEXT PRIMARY KEY,
+		request_hash TEXT NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		content_type TEXT,
+		response BLOB,
+		created_at DATETIME DEFAULT (datetime('now', 'localtime'))
+	);`
+
+	if _, err := db.Exec(createIdempotencyTable); err != nil {
+		return nil, err
+	}
+
+	// 期限切れのキーの削除を高速化
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at)"); err != nil {
+		return nil, err
+	}
+
+	// 5. レコードの送信履歴（追記のみ）
+	// payloadは送られた内容、resultはMERGE後に保存された内容（どちらもDB上の名前）
+	createSubmissionTable := `
+	CREATE TABLE IF NOT EXISTS record_submissions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id INTEGER NOT NULL REFERENCES sessions(id),
+		payload BLOB NOT NULL,
+		result BLOB NOT NULL,
+		ip_address TEXT,
+		idempotency_key TEXT,
+		source TEXT NOT NULL,
+		played_at DATETIME,
+		created_at DATETIME DEFAULT (datetime('now', 'localtime'))
+	);`
+
+	if _, err := db.Exec(createSubmissionTable); err != nil {
+		return nil, err
+	}
+
+	// セッションごとの履歴の取得を高速化
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_record_submissions_session_id ON record_submissions(session_id)"); err != nil {
+		return nil, err
+	}
+
+	// 6. プレイヤープロフィール（uuidごとに1件）
+	// dataにはPLAYER_SCHEMAで定義した独自項目を保存する
+	createPlayerTable := `
+	CREATE TABLE IF NOT EXISTS players (
+		uuid TEXT PRIMARY KEY,
+		display_name TEXT NOT NULL,
+		country TEXT,
+		avatar_url TEXT,
+		data BLOB NOT NULL DEFAULT (jsonb('{}')),
+		created_at DATETIME DEFAULT (datetime('now', 'localtime')),
+		updated_at DATETIME DEFAULT (datetime('now', 'localtime'))
+	);`
+
+	if _, err := db.Exec(createPlayerTable); err != nil {
+		return nil, err
+	}
+
+	// 7. Webhookの送信待ち・送信結果（再起動しても送信待ちを失わないようにDBに保存する）
+	// payloadは署名した本文そのもの（送り直しても同じ内容・署名になる）
+	createWebhookTables := `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		endpoint TEXT NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at DATETIME DEFAULT (datetime('now', 'localtime')),
+		last_status_code INTEGER,
+		last_error TEXT,
+		delivered_at DATETIME,
+		created_at DATETIME DEFAULT (datetime('now', 'localtime'))
+	);
+	CREATE TABLE IF NOT EXISTS webhook_attempts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		delivery_id INTEGER NOT NULL REFERENCES webhook_deliveries(id),
+		attempt INTEGER NOT NULL,
+		status_code INTEGER,
+		error TEXT,
+		duration_ms REAL,
+		created_at DATETIME DEFAULT (datetime('now', 'localtime'))
+	);`
+
+	if _, err := db.Exec(createWebhookTables); err != nil {
+		return nil, err
+	}
+
+	// 送信待ちの取り出しと、送信先ごとの試行履歴の取得を高速化
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_status ON webhook_deliveries(status, next_attempt_at)"); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_webhook_attempts_delivery_id ON webhook_attempts(delivery_id)"); err != nil {
+		return nil, err
+	}
+
+	// 8. プレイヤーのグループ（フレンドやクラスなど、グループ内のランキングに使う）
+	// owner_uuidは作成したプレイヤー（管理者が作成したグループはNULL）
+	createGroupTables := `
+	CREATE TABLE IF NOT EXISTS player_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		owner_uuid TEXT,
+		created_at DATETIME DEFAULT (datetime('now', 'localtime')),
+		updated_at DATETIME DEFAULT (datetime('now', 'localtime'))
+	);
+	CREATE TABLE IF NOT EXISTS player_group_members (
+		group_id INTEGER NOT NULL REFERENCES player_groups(id),
+		uuid TEXT NOT NULL,
+		created_at DATETIME DEFAULT (datetime('now', 'localtime')),
+		PRIMARY KEY (group_id, uuid)
+	);`
+
+	if _, err := db.Exec(createGroupTables); err != nil {
+		return nil, err
+	}
+
+	// 作成したグループの数の確認と、所属しているグループの検索を高速化
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_player_groups_owner_uuid ON player_groups(owner_uuid)"); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_player_group_members_uuid ON player_group_members(uuid)"); err != nil {
+		return nil, err
+	}
+
+	// 9. 一度だけ実行するスキーマ変更・データ移行
+	if err := applyMigrations(db, cfg); err != nil {
+		return nil, err
+	}
+
+	// 10. ログの全文検索（移行後のcontentで索引を作る）
+	if err := setupLogSearch(db); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
 
@@ -134,26 +302,3 @@ func setupDynamicColumns(db *sql.DB, cfg *config.Config) error {
 	}
 	return nil
 }
-
-// 古いログを削除する関数
-func CleanupOldLogs(db *sql.DB, days int) {
-	if days <= 0 {
-		return // 0以下の場合は削除しない設定
-	}
-
-	go func() {
-		query := "DELETE FROM logs WHERE created_at < datetime('now', ?)"
-		interval := fmt.Sprintf("-%d days", days)
-
-		result, err := db.Exec(query, interval)
-		if err != nil {
-			log.Printf("Cleanup failed: %v", err)
-			return
-		}
-
-		rows, _ := result.RowsAffected()
-		if rows > 0 {
-			log.Printf("Cleanup: Removed %d old log entries.", rows)
-		}
-	}()
-}
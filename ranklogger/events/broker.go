@@ -0,0 +1,135 @@
+package events
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// トピック（発行する側と購読する側で揃える）
+const (
+	TopicRecords = "records" // レコードの登録・無効化・ロールバック、プレイヤープロフィールの更新
+	TopicLogs    = "logs"    // POST /logs で登録されたログ
+)
+
+// RecordEvent: TopicRecordsで通知する内容
+type RecordEvent struct {
+	Action    string // post, batch, import, disable, rollback, player
+	SessionID int64  // 対象のセッション（まとめて変わった場合は0）
+	UUID      string // プレイヤープロフィールの更新の場合
+}
+
+// LogEvent: TopicLogsで通知する内容（1回のPOST /logsで登録されたログ）
+type LogEvent struct {
+	SessionID int64
+	UUID      string
+	PlayCount *int
+	Logs      []LogEntry
+}
+
+// LogEntry: 登録された1件のログ
+type LogEntry struct {
+	ID        int64
+	Type      int
+	Content   string
+	Data      json.RawMessage // LOG_SCHEMAの構造化データ（なければnil）
+	CreatedAt string
+}
+
+// Event: 購読者に届く通知
+type Event struct {
+	Topic string
+	Data  interface{}
+}
+
+// Broker: プロセス内の簡易的なPub/Sub
+// 発行はブロックしない（購読者のバッファが埋まっている場合はその購読者への通知を捨てる）
+type Broker struct {
+	mu     sync.Mutex
+	subs   map[string]map[*Subscription]struct{}
+	closed bool
+}
+
+// Subscription: 1つの購読
+// Cは購読の解除またはBrokerの終了で閉じられる
+type Subscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	topic   string
+	broker  *Broker
+	dropped atomic.Int64
+	once    sync.Once
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[string]map[*Subscription]struct{})}
+}
+
+// Subscribe: トピックを購読する
+// buffer が1の場合、処理中に届いた複数の通知は1つにまとめられる（最新の状態を取り直す用途向け）
+func (b *Broker) Subscribe(topic string, buffer int) *Subscription {
+	ch := make(chan Event, buffer)
+	s := &Subscription{C: ch, ch: ch, topic: topic, broker: b}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return s
+	}
+	if b.subs[topic] == nil {
+		b.subs[topic] = make(map[*Subscription]struct{})
+	}
+	b.subs[topic][s] = struct{}{}
+	return s
+}
+
+// Publish: トピックの購読者全員に通知する
+func (b *Broker) Publish(topic string, data interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs[topic] {
+		select {
+		case s.ch <- Event{Topic: topic, Data: data}:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribers: トピックの購読者数
+func (b *Broker) Subscribers(topic string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs[topic])
+}
+
+// Close: すべての購読を終了する（サーバーの停止時に、接続中のストリームを終わらせる）
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for _, subs := range b.subs {
+		for s := range subs {
+			s.once.Do(func() { close(s.ch) })
+		}
+	}
+	b.subs = make(map[string]map[*Subscription]struct{})
+}
+
+// Close: 購読を解除する（何度呼んでもよい）
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	delete(s.broker.subs[s.topic], s)
+	s.once.Do(func() { close(s.ch) })
+}
+
+// Dropped: バッファが埋まっていて捨てた通知の数
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
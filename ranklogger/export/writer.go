@@ -0,0 +1,230 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// 列の型（Parquetの列型と、値の変換に使う）
+type Kind int
+
+const (
+	KindString Kind = iota
+	KindInt
+	KindFloat
+	KindBool
+)
+
+type Column struct {
+	Name string
+	Kind Kind
+}
+
+// Writer: 1行ずつ書き出すストリーミング出力（全件をメモリに載せない）
+type Writer interface {
+	WriteRow(values []interface{}) error
+	Close() error
+}
+
+// 対応している出力形式と、そのContent-Type・拡張子
+var Formats = map[string]struct {
+	ContentType string
+	Extension   string
+}{
+	"csv":     {"text/csv; charset=utf-8", "csv"},
+	"ndjson":  {"application/x-ndjson", "ndjson"},
+	"parquet": {"application/vnd.apache.parquet", "parquet"},
+}
+
+func NewWriter(format string, w io.Writer, columns []Column) (Writer, error) {
+	switch format {
+	case "csv":
+		return newCSVWriter(w, columns)
+	case "ndjson":
+		return &ndjsonWriter{enc: json.NewEncoder(w), columns: columns}, nil
+	case "parquet":
+		return newParquetWriter(w, columns), nil
+	}
+	return nil, fmt.Errorf("unknown format: %s", format)
+}
+
+// SQLiteから読み取った値を列の型に揃える（NULLはnilのまま）
+func normalize(v interface{}, kind Kind) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case []byte:
+		v = string(val)
+	case time.Time:
+		return val.Format(time.RFC3339)
+	}
+
+	switch kind {
+	case KindInt:
+		switch val := v.(type) {
+		case int64:
+			return val
+		case float64:
+			return int64(val)
+		case bool:
+			if val {
+				return int64(1)
+			}
+			return int64(0)
+		case string:
+			if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+				return n
+			}
+		}
+		return nil
+	case KindFloat:
+		switch val := v.(type) {
+		case int64:
+			return float64(val)
+		case float64:
+			return val
+		case string:
+			if f, err := strconv.ParseFloat(val, 64); err == nil {
+				return f
+			}
+		}
+		return nil
+	case KindBool:
+		switch val := v.(type) {
+		case bool:
+			return val
+		case int64:
+			return val != 0
+		}
+		return nil
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// --- CSV ---
+
+type csvWriter struct {
+	w       *csv.Writer
+	columns []Column
+	record  []string
+}
+
+func newCSVWriter(w io.Writer, columns []Column) (*csvWriter, error) {
+	cw := &csvWriter{w: csv.NewWriter(w), columns: columns, record: make([]string, len(columns))}
+	header := make([]string, len(columns))
+	for i, col := range columns {
+		header[i] = col.Name
+	}
+	return cw, cw.w.Write(header)
+}
+
+func (cw *csvWriter) WriteRow(values []interface{}) error {
+	for i, col := range cw.columns {
+		switch v := normalize(values[i], col.Kind).(type) {
+		case nil:
+			cw.record[i] = ""
+		case string:
+			cw.record[i] = v
+		case float64:
+			cw.record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			cw.record[i] = fmt.Sprint(v)
+		}
+	}
+	return cw.w.Write(cw.record)
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// --- NDJSON ---
+
+type ndjsonWriter struct {
+	enc     *json.Encoder
+	columns []Column
+}
+
+func (nw *ndjsonWriter) WriteRow(values []interface{}) error {
+	row := make(map[string]interface{}, len(nw.columns))
+	for i, col := range nw.columns {
+		row[col.Name] = normalize(values[i], col.Kind)
+	}
+	return nw.enc.Encode(row)
+}
+
+func (nw *ndjsonWriter) Close() error { return nil }
+
+// --- Parquet ---
+
+// 行グループ単位でファイルに書き出すので、メモリに載るのは1行グループ分だけ
+const parquetRowGroupSize = 10000
+
+type parquetWriter struct {
+	w       *parquet.Writer
+	columns []Column
+	index   []int // columns[i] がParquetの何番目の列か（Parquetの列は名前順に並ぶ）
+	row     parquet.Row
+}
+
+func newParquetWriter(w io.Writer, columns []Column) *parquetWriter {
+	group := parquet.Group{}
+	for _, col := range columns {
+		var node parquet.Node
+		switch col.Kind {
+		case KindInt:
+			node = parquet.Int(64)
+		case KindFloat:
+			node = parquet.Leaf(parquet.DoubleType)
+		case KindBool:
+			node = parquet.Leaf(parquet.BooleanType)
+		default:
+			node = parquet.String()
+		}
+		group[col.Name] = parquet.Optional(node)
+	}
+	schema := parquet.NewSchema("export", group)
+
+	pw := &parquetWriter{
+		w:       parquet.NewWriter(w, schema, parquet.MaxRowsPerRowGroup(parquetRowGroupSize)),
+		columns: columns,
+		index:   make([]int, len(columns)),
+		row:     make(parquet.Row, len(columns)),
+	}
+	for i, col := range columns {
+		leaf, _ := schema.Lookup(col.Name)
+		pw.index[i] = leaf.ColumnIndex
+	}
+	return pw
+}
+
+func (pw *parquetWriter) WriteRow(values []interface{}) error {
+	for i, col := range pw.columns {
+		colIndex := pw.index[i]
+		v := normalize(values[i], col.Kind)
+		if v == nil {
+			pw.row[colIndex] = parquet.NullValue().Level(0, 0, colIndex)
+			continue
+		}
+		if s, ok := v.(string); ok {
+			v = []byte(s)
+		}
+		pw.row[colIndex] = parquet.ValueOf(v).Level(0, 1, colIndex)
+	}
+	_, err := pw.w.WriteRows([]parquet.Row{pw.row})
+	return err
+}
+
+func (pw *parquetWriter) Close() error {
+	return pw.w.Close()
+}
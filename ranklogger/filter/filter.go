@@ -0,0 +1,204 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+
+	"ranklogger/config"
+)
+
+// 見た目が似ている文字（数字や記号、キリル文字・ギリシャ文字など）を英字に寄せる
+var lookAlikes = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g',
+	'@': 'a', '$': 's', '!': 'i', '|': 'l', '+': 't',
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x',
+}
+
+// Filter: 単語リストと正規表現による不適切な表現の検出・伏せ字化
+// 単語リストは見た目が似ている文字をそろえ、区切り文字を取り除いた上で比較する（f.u.c.k なども検出できる）
+// 正規表現は元の文字列に対して大文字小文字を区別せずに適用する
+type Filter struct {
+	cfg config.ContentFilterConfig
+
+	mu       sync.RWMutex
+	words    []string
+	patterns []*regexp.Regexp
+}
+
+// Stats: 読み込んだ単語と正規表現の数
+type Stats struct {
+	Words    int `json:"words"`
+	Patterns int `json:"patterns"`
+}
+
+// New: 設定ファイルで指定された単語リストと正規表現リストを読み込む
+// 無効の場合は何も検出しないFilterを返す
+func New(cfg config.ContentFilterConfig) (*Filter, error) {
+	f := &Filter{cfg: cfg}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload: リストを読み込み直す（失敗した場合はそれまでのリストを使い続ける）
+func (f *Filter) Reload() (Stats, error) {
+	if !f.cfg.Enabled {
+		return Stats{}, nil
+	}
+
+	var words []string
+	seen := make(map[string]bool)
+	for _, path := range f.cfg.WordLists {
+		lines, err := readList(path)
+		if err != nil {
+			return Stats{}, err
+		}
+		for _, line := range lines {
+			word := string(normalize(line).runes)
+			if word == "" || seen[word] {
+				continue
+			}
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+
+	var patterns []*regexp.Regexp
+	for _, path := range f.cfg.PatternLists {
+		lines, err := readList(path)
+		if err != nil {
+			return Stats{}, err
+		}
+		for _, line := range lines {
+			re, err := regexp.Compile("(?i)" + line)
+			if err != nil {
+				return Stats{}, fmt.Errorf("%s: invalid pattern %q: %w", path, line, err)
+			}
+			patterns = append(patterns, re)
+		}
+	}
+
+	f.mu.Lock()
+	f.words = words
+	f.patterns = patterns
+	f.mu.Unlock()
+	return Stats{Words: len(words), Patterns: len(patterns)}, nil
+}
+
+// Check: 不適切な表現が含まれているかを調べ、該当部分を伏せ字にした文字列を返す
+// 伏せ字にしても文字数は変わらない
+func (f *Filter) Check(s string) (string, bool) {
+	if !f.cfg.Enabled || s == "" {
+		return s, false
+	}
+
+	f.mu.RLock()
+	words, patterns := f.words, f.patterns
+	f.mu.RUnlock()
+
+	original := []rune(s)
+	hit := make([]bool, len(original))
+	matched := false
+
+	// 単語リスト（正規化した文字列の中で探し、元の文字の位置に戻して印を付ける）
+	n := normalize(s)
+	text := string(n.runes)
+	for _, word := range words {
+		for start := 0; ; {
+			i := strings.Index(text[start:], word)
+			if i < 0 {
+				break
+			}
+			from := len([]rune(text[:start+i]))
+			to := from + len([]rune(word)) - 1
+			for j := n.origin[from]; j <= n.origin[to]; j++ {
+				hit[j] = true
+			}
+			matched = true
+			start += i + len(word)
+		}
+	}
+
+	// 正規表現（バイト位置を文字の位置に直して印を付ける）
+	for _, re := range patterns {
+		for _, loc := range re.FindAllStringIndex(s, -1) {
+			from := len([]rune(s[:loc[0]]))
+			to := from + len([]rune(s[loc[0]:loc[1]]))
+			for j := from; j < to; j++ {
+				hit[j] = true
+			}
+			matched = true
+		}
+	}
+
+	if !matched {
+		return s, false
+	}
+	mask := []rune(f.cfg.MaskChar)[0]
+	for i := range original {
+		if hit[i] && !unicode.IsSpace(original[i]) {
+			original[i] = mask
+		}
+	}
+	return string(original), true
+}
+
+// 正規化した文字列と、各文字が元の文字列の何文字目から来たか
+type normalized struct {
+	runes  []rune
+	origin []int
+}
+
+// normalize: 比較用に文字列をそろえる
+// 互換文字（全角英数字など）の分解、小文字化、カタカナのひらがな化、似た文字の置き換えを行い、空白・記号を取り除く
+func normalize(s string) normalized {
+	var n normalized
+	for i, r := range []rune(s) {
+		for _, c := range norm.NFKC.String(string(r)) {
+			c = unicode.ToLower(c)
+			if c >= 'ァ' && c <= 'ヶ' {
+				c -= 'ァ' - 'ぁ'
+			}
+			if to, ok := lookAlikes[c]; ok {
+				c = to
+			}
+			if !unicode.IsLetter(c) && !unicode.IsNumber(c) {
+				continue
+			}
+			n.runes = append(n.runes, c)
+			n.origin = append(n.origin, i)
+		}
+	}
+	return n
+}
+
+// readList: 1行に1件のリストファイルを読み込む（空行と#で始まる行は無視）
+func readList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
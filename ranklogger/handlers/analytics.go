@@ -0,0 +1,489 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+	"ranklogger/export"
+)
+
+// ゲームプレイの分析（管理者用）
+// sessionsとlogsから、分布・アクティブ数・ログの推移・継続率を集計する
+// 期間（since, until）とタグ（そのタグのレコードを持つセッション）で絞り込める
+
+// 集計の単位（日時の列をその単位の先頭の日時の文字列にする式）
+// 週は月曜始まり
+var analyticsBuckets = map[string]string{
+	"hour":  "strftime('%%Y-%%m-%%d %%H:00', %s)",
+	"day":   "date(%s)",
+	"week":  "date(%s, 'weekday 0', '-6 days')",
+	"month": "strftime('%%Y-%%m-01', %s)",
+}
+
+// bucketExpr: ?bucket= の値を検証し、集計の単位の式を返す
+func bucketExpr(c *fiber.Ctx, column, def string, allowed ...string) (string, string, error) {
+	bucket := c.Query("bucket", def)
+	if !slices.Contains(allowed, bucket) {
+		return "", "", fmt.Errorf("bucket must be one of %s", strings.Join(allowed, ", "))
+	}
+	return bucket, fmt.Sprintf(analyticsBuckets[bucket], column), nil
+}
+
+// analyticsTag: ?tag= の条件（指定なしは空）
+func analyticsTag(c *fiber.Ctx, cfg *config.Config) (string, string, error) {
+	tag := c.Query("tag")
+	if tag == "" {
+		return "", "", nil
+	}
+	cond, ok := tagCondition(cfg, tag, "s.data")
+	if !ok {
+		return "", "", fmt.Errorf("Unknown tag")
+	}
+	return tag, cond, nil
+}
+
+// activitySource: プレイヤーの活動（セッションの作成とログの送信）の uuid, at を返すクエリ
+// play_countが無効の場合はプレイヤーごとにセッションが1つなので、ログの送信も活動として数える
+func activitySource(tagCond string) string {
+	where := ""
+	if tagCond != "" {
+		where = " WHERE " + tagCond
+	}
+	return fmt.Sprintf(`
+		SELECT s.uuid, s.created_at AS at FROM sessions s%s
+		UNION ALL
+		SELECT s.uuid, l.created_at AS at FROM logs l JOIN sessions s ON s.id = l.session_id%s`, where, where)
+}
+
+// numericSchemaField: 分布を集計できる数値型の項目を探し、DB上の名前を返す
+// タグ指定ありの場合はタグ無しとそのタグの項目、タグ指定なしの場合はDB上の名前（{TAG}_{NAME}）で指定する
+func numericSchemaField(cfg *config.Config, tag, column string) (config.SchemaConfig, string, bool) {
+	for _, field := range cfg.Schema {
+		if !slices.Contains(cfg.TypeValidation.Numbers, field.Type) {
+			continue
+		}
+		dbName := field.Name
+		if field.Tag != "" {
+			dbName = field.Tag + "_" + field.Name
+		}
+		switch {
+		case tag == "" && dbName == column:
+		case tag != "" && (field.Tag == "" || field.Tag == tag) && field.Name == column:
+		default:
+			continue
+		}
+		return field, dbName, true
+	}
+	return config.SchemaConfig{}, "", false
+}
+
+// histogramBins: valueの値を lo〜hi の範囲で等幅の区間に分けて数える（範囲外の値は数えない）
+// 整数の項目は幅も整数にして、1つの値が2つの区間にまたがらないようにする（各区間はfrom以上to未満）
+func histogramBins(ctx context.Context, db *sql.DB, from, value string, where []string, args []interface{}, lo, hi float64, bins int, integer bool) ([]fiber.Map, float64, int64, error) {
+	var width float64
+	if integer {
+		lo, hi = math.Floor(lo), math.Floor(hi)
+		span := hi - lo + 1
+		width = math.Ceil(span / float64(bins))
+		bins = int(math.Ceil(span / width))
+	} else if hi == lo {
+		bins, width = 1, 1
+	} else {
+		width = (hi - lo) / float64(bins)
+	}
+
+	// 最大値はちょうど最後の区間の終わりになるため、最後の区間に含める
+	bucket := fmt.Sprintf("MIN(%d, CAST((%s - ?) / ? AS INTEGER))", bins-1, value)
+	query := fmt.Sprintf(`
+		SELECT %s AS bucket, COUNT(*) FROM %s
+		WHERE %s AND %s >= ? AND %s <= ?
+		GROUP BY bucket`, bucket, from, strings.Join(where, " AND "), value, value)
+	queryArgs := append([]interface{}{lo, width}, args...)
+	queryArgs = append(queryArgs, lo, hi)
+
+	rows, err := db.QueryContext(ctx, query, queryArgs...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	counts := make([]int64, bins)
+	var inRange int64
+	for rows.Next() {
+		var i int
+		var n int64
+		if err := rows.Scan(&i, &n); err != nil {
+			return nil, 0, 0, err
+		}
+		if i >= 0 && i < bins {
+			counts[i] = n
+			inRange += n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	histogram := make([]fiber.Map, bins)
+	for i := range counts {
+		histogram[i] = fiber.Map{
+			"from":  lo + float64(i)*width,
+			"to":    lo + float64(i+1)*width,
+			"count": counts[i],
+		}
+	}
+	return histogram, width, inRange, nil
+}
+
+// GetAnalyticsHistogram: 数値型の項目の分布（等幅のヒストグラム）
+// 例: ?column=play_time&bins=20。無効化されたセッションは含めない（include_disabled=trueで含める）
+// min, maxを指定するとその範囲だけを分割し、範囲外の値は数えない。統計値（min, max, mean）は範囲によらずすべての値から求める
+func GetAnalyticsHistogram(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		tag, tagCond, err := analyticsTag(c, cfg)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		column := c.Query("column")
+		field, dbName, ok := numericSchemaField(cfg, tag, column)
+		if !ok {
+			return c.Status(400).JSON(fiber.Map{"error": "column must be a numeric field of RECORD_SCHEMA"})
+		}
+		bins := c.QueryInt("bins", 20)
+		if bins < 1 || bins > 200 {
+			return c.Status(400).JSON(fiber.Map{"error": "bins must be between 1 and 200"})
+		}
+
+		value := fmt.Sprintf("(s.data ->> '$.%s')", dbName)
+		where := []string{value + " IS NOT NULL"}
+		var args []interface{}
+		if !c.QueryBool("include_disabled", false) {
+			where = append(where, "s.disable = FALSE")
+		}
+		if tagCond != "" {
+			where = append(where, tagCond)
+		}
+		where, args, err = timeRange(c, "s.created_at", where, args)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		var count int64
+		var minValue, maxValue, mean sql.NullFloat64
+		err = db.QueryRowContext(ctx, fmt.Sprintf(
+			"SELECT COUNT(*), MIN(%s), MAX(%s), AVG(%s) FROM sessions s WHERE %s",
+			value, value, value, strings.Join(where, " AND ")), args...).Scan(&count, &minValue, &maxValue, &mean)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to compute histogram"})
+		}
+
+		result := fiber.Map{
+			"column": column,
+			"tag":    tag,
+			"count":  count,
+			"min":    nil,
+			"max":    nil,
+			"mean":   nil,
+			"bins":   []fiber.Map{},
+		}
+		if count == 0 {
+			return c.JSON(result)
+		}
+		result["min"], result["max"], result["mean"] = minValue.Float64, maxValue.Float64, mean.Float64
+
+		// 分割する範囲
+		lo, hi := minValue.Float64, maxValue.Float64
+		for _, p := range []struct {
+			name  string
+			value *float64
+		}{{"min", &lo}, {"max", &hi}} {
+			if str := c.Query(p.name); str != "" {
+				v, err := strconv.ParseFloat(str, 64)
+				// NaNとInfは範囲に使えない
+				if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+					return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("%s must be a number", p.name)})
+				}
+				*p.value = v
+			}
+		}
+		if hi < lo {
+			return c.Status(400).JSON(fiber.Map{"error": "max must be >= min"})
+		}
+
+		histogram, width, inRange, err := histogramBins(ctx, db, "sessions s", value, where, args, lo, hi, bins,
+			columnKind(cfg, field) == export.KindInt)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to compute histogram"})
+		}
+		result["bins"] = histogram
+		result["bin_width"] = width
+		result["in_range"] = inRange
+		return c.JSON(result)
+	}
+}
+
+// GetAnalyticsActive: 期間ごとのアクティブなプレイヤー（UUID）の数（bucket: day, week, month）
+// セッションの作成とログの送信を活動として数える
+func GetAnalyticsActive(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tag, tagCond, err := analyticsTag(c, cfg)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		bucket, expr, err := bucketExpr(c, "a.at", "day", "day", "week", "month")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		where, args, err := timeRange(c, "a.at", []string{"1 = 1"}, nil)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		query := fmt.Sprintf(`
+			SELECT %s AS bucket, COUNT(DISTINCT a.uuid)
+			FROM (%s) a
+			WHERE %s
+			GROUP BY bucket ORDER BY bucket`, expr, activitySource(tagCond), strings.Join(where, " AND "))
+		rows, err := db.QueryContext(c.UserContext(), query, args...)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to compute active players"})
+		}
+		defer rows.Close()
+
+		series := []fiber.Map{}
+		for rows.Next() {
+			var b string
+			var n int64
+			if err := rows.Scan(&b, &n); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to compute active players"})
+			}
+			series = append(series, fiber.Map{"bucket": b, "active_uuids": n})
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to compute active players"})
+		}
+
+		return c.JSON(fiber.Map{
+			"bucket": bucket,
+			"tag":    tag,
+			"series": series,
+		})
+	}
+}
+
+// GetAnalyticsSessions: プレイヤーごとのセッション数の分布（何回プレイしたプレイヤーが何人いるか）
+// play_countが無効の場合はプレイヤーごとにセッションが1つになる
+func GetAnalyticsSessions(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tag, tagCond, err := analyticsTag(c, cfg)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		where := []string{"1 = 1"}
+		if tagCond != "" {
+			where = append(where, tagCond)
+		}
+		where, args, err := timeRange(c, "s.created_at", where, nil)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		query := fmt.Sprintf(`
+			SELECT n, COUNT(*) FROM (
+				SELECT s.uuid, COUNT(*) AS n FROM sessions s WHERE %s GROUP BY s.uuid
+			)
+			GROUP BY n ORDER BY n`, strings.Join(where, " AND "))
+		rows, err := db.QueryContext(c.UserContext(), query, args...)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to compute sessions per player"})
+		}
+		defer rows.Close()
+
+		distribution := []fiber.Map{}
+		var players, sessions int64
+		for rows.Next() {
+			var n, count int64
+			if err := rows.Scan(&n, &count); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to compute sessions per player"})
+			}
+			distribution = append(distribution, fiber.Map{"sessions": n, "players": count})
+			players += count
+			sessions += n * count
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to compute sessions per player"})
+		}
+
+		var mean interface{}
+		if players > 0 {
+			mean = float64(sessions) / float64(players)
+		}
+		return c.JSON(fiber.Map{
+			"tag":          tag,
+			"players":      players,
+			"sessions":     sessions,
+			"mean":         mean,
+			"distribution": distribution,
+		})
+	}
+}
+
+// GetAnalyticsLogTypes: 期間ごと・種類ごとのログの件数（bucket: hour, day, week, month）
+// typeで種類を絞り込める（IDまたはLOG_TYPESの名前）
+func GetAnalyticsLogTypes(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tag, tagCond, err := analyticsTag(c, cfg)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		bucket, expr, err := bucketExpr(c, "l.created_at", "day", "hour", "day", "week", "month")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		logTypes, err := parseLogTypes(c, cfg)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		from := "logs l"
+		where := []string{"1 = 1"}
+		var args []interface{}
+		if tagCond != "" {
+			from += " JOIN sessions s ON s.id = l.session_id"
+			where = append(where, tagCond)
+		}
+		if len(logTypes) > 0 {
+			cond, typeArgs := logTypeCondition("l.type", logTypes)
+			where = append(where, cond)
+			args = append(args, typeArgs...)
+		}
+		where, args, err = timeRange(c, "l.created_at", where, args)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		query := fmt.Sprintf(`
+			SELECT %s AS bucket, l.type, COUNT(*) FROM %s
+			WHERE %s
+			GROUP BY bucket, l.type ORDER BY bucket, l.type`, expr, from, strings.Join(where, " AND "))
+		rows, err := db.QueryContext(c.UserContext(), query, args...)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to count logs"})
+		}
+		defer rows.Close()
+
+		series := []fiber.Map{}
+		for rows.Next() {
+			var b string
+			var lType int
+			var n int64
+			if err := rows.Scan(&b, &lType, &n); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to count logs"})
+			}
+			entry := fiber.Map{"bucket": b, "type": lType, "count": n}
+			setLogTypeInfo(cfg, entry, lType)
+			series = append(series, entry)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to count logs"})
+		}
+
+		return c.JSON(fiber.Map{
+			"bucket": bucket,
+			"tag":    tag,
+			"series": series,
+		})
+	}
+}
+
+// GetAnalyticsRetention: 初めて活動した日（週）ごとのプレイヤーの継続率
+// cohortごとに、初回から0, 1, 2, ... 日（週）後に活動したプレイヤーの数を返す。since, untilは初めて活動した日時で絞り込む
+func GetAnalyticsRetention(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tag, tagCond, err := analyticsTag(c, cfg)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		cohort := c.Query("cohort", "day")
+		days := map[string]int{"day": 1, "week": 7}[cohort]
+		if days == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "cohort must be day or week"})
+		}
+		periods := c.QueryInt("periods", 7)
+		if periods < 1 || periods > 365 {
+			return c.Status(400).JSON(fiber.Map{"error": "periods must be between 1 and 365"})
+		}
+		where, args, err := timeRange(c, "first_at", []string{"1 = 1"}, nil)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		query := fmt.Sprintf(`
+			WITH activity AS (%s),
+			first_seen AS (SELECT uuid, MIN(at) AS first_at FROM activity GROUP BY uuid),
+			cohorts AS (SELECT uuid, %s AS cohort FROM first_seen WHERE %s)
+			SELECT c.cohort, CAST(julianday(%s) - julianday(c.cohort) AS INTEGER) / %d AS period, COUNT(DISTINCT a.uuid)
+			FROM cohorts c JOIN activity a ON a.uuid = c.uuid
+			GROUP BY c.cohort, period
+			HAVING period <= ?
+			ORDER BY c.cohort, period`,
+			activitySource(tagCond),
+			fmt.Sprintf(analyticsBuckets[cohort], "first_at"), strings.Join(where, " AND "),
+			fmt.Sprintf(analyticsBuckets[cohort], "a.at"), days)
+		args = append(args, periods)
+
+		rows, err := db.QueryContext(c.UserContext(), query, args...)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to compute retention"})
+		}
+		defer rows.Close()
+
+		cohorts := []fiber.Map{}
+		var retained []int64
+		for rows.Next() {
+			var name string
+			var period int
+			var n int64
+			if err := rows.Scan(&name, &period, &n); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to compute retention"})
+			}
+			if len(cohorts) == 0 || cohorts[len(cohorts)-1]["cohort"] != name {
+				retained = make([]int64, periods+1)
+				cohorts = append(cohorts, fiber.Map{"cohort": name, "retained": retained})
+			}
+			retained[period] = n
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to compute retention"})
+		}
+
+		// 初回（period 0）の人数がcohortの大きさ
+		for _, co := range cohorts {
+			retained := co["retained"].([]int64)
+			rates := make([]float64, len(retained))
+			for i, n := range retained {
+				if retained[0] > 0 {
+					rates[i] = float64(n) / float64(retained[0])
+				}
+			}
+			co["size"] = retained[0]
+			co["rates"] = rates
+		}
+
+		return c.JSON(fiber.Map{
+			"cohort":  cohort,
+			"periods": periods,
+			"tag":     tag,
+			"cohorts": cohorts,
+		})
+	}
+}
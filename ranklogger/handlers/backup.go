@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"database/sql"
+	"path/filepath"
+
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+	"ranklogger/database"
+)
+
+// PostBackup: 稼働中のDBのスナップショットを作成する（管理者用）
+func PostBackup(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		path, err := database.Backup(c.UserContext(), db, cfg.Backup.Dir)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Backup failed"})
+		}
+
+		// 定期バックアップと同じく、古いものは削除する
+		removed, err := database.RotateBackups(cfg.Backup.Dir, cfg.Backup.Keep)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Backup rotation failed"})
+		}
+
+		return c.Status(201).JSON(fiber.Map{
+			"message": "Backup created successfully",
+			"name":    filepath.Base(path),
+			"rotated": removed,
+		})
+	}
+}
+
+// GetBackups: バックアップの一覧を新しい順に返す（管理者用）
+func GetBackups(cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		backups, err := database.ListBackups(cfg.Backup.Dir)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to list backups"})
+		}
+		return c.JSON(fiber.Map{
+			"backups": backups,
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+	"ranklogger/export"
+)
+
+// ランキングの値の分布とパーセンタイル（プレイヤー向け）
+// 「上位3%」のような表示やヒストグラムの描画に使う。ランキングと同じく無効化されていないレコードが対象
+// 全件の集計になるため、タグと並べ替えの項目ごとに結果を保持し、DISTRIBUTION:REFRESH_SECONDSごとに計算し直す
+
+// DistributionCache: 分布の計算結果（キーはタグとDB上の項目名）
+type DistributionCache struct {
+	db  *sql.DB
+	cfg *config.Config
+
+	mu      sync.Mutex
+	entries map[string]*distributionEntry
+}
+
+type distributionEntry struct {
+	mu         sync.Mutex // 同じキーの計算は1つだけ行い、他のリクエストはその結果を待つ
+	result     fiber.Map
+	computedAt time.Time
+}
+
+func NewDistributionCache(db *sql.DB, cfg *config.Config) *DistributionCache {
+	return &DistributionCache{db: db, cfg: cfg, entries: make(map[string]*distributionEntry)}
+}
+
+// get: 保持している結果を返す（期限切れ・未計算の場合は計算する）。結果を計算した日時も返す
+func (d *DistributionCache) get(ctx context.Context, tag, column, order string, integer bool) (fiber.Map, time.Time, error) {
+	d.mu.Lock()
+	key := tag + "/" + column
+	entry, ok := d.entries[key]
+	if !ok {
+		entry = &distributionEntry{}
+		d.entries[key] = entry
+	}
+	d.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	refresh := time.Duration(d.cfg.Distribution.RefreshSeconds) * time.Second
+	if entry.result != nil && time.Since(entry.computedAt) < refresh {
+		return entry.result, entry.computedAt, nil
+	}
+	result, err := computeDistribution(ctx, d.db, d.cfg, column, order, integer)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	entry.result, entry.computedAt = result, time.Now()
+	return entry.result, entry.computedAt, nil
+}
+
+// computeDistribution: 値の範囲を等幅に分けた件数と、パーセンタイルの値を計算する
+// pXは上位(100-X)%に入るために必要な値（並び順がASCの項目では小さいほど上位）
+func computeDistribution(ctx context.Context, db *sql.DB, cfg *config.Config, column, order string, integer bool) (fiber.Map, error) {
+	where := []string{"s.disable = FALSE", fmt.Sprintf("s.%s IS NOT NULL", column)}
+	var count int64
+	var minValue, maxValue sql.NullFloat64
+	err := db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT COUNT(*), MIN(s.%s), MAX(s.%s) FROM sessions s WHERE %s AND %s", column, column, where[0], where[1])).
+		Scan(&count, &minValue, &maxValue)
+	if err != nil {
+		return nil, err
+	}
+
+	percentiles := fiber.Map{}
+	result := fiber.Map{
+		"count":       count,
+		"min":         nil,
+		"max":         nil,
+		"bin_width":   nil,
+		"bins":        []fiber.Map{},
+		"percentiles": percentiles,
+	}
+	for _, p := range cfg.Distribution.Percentiles {
+		percentiles["p"+strconv.Itoa(p)] = nil
+	}
+	if count == 0 {
+		return result, nil
+	}
+
+	bins, width, _, err := histogramBins(ctx, db, "sessions s", "s."+column, where, nil,
+		minValue.Float64, maxValue.Float64, cfg.Distribution.Bins, integer)
+	if err != nil {
+		return nil, err
+	}
+	result["min"] = minValue.Float64
+	result["max"] = maxValue.Float64
+	result["bin_width"] = width
+	result["bins"] = bins
+
+	// 上位からk番目（0始まり）の値。項目の索引を使うため、件数が多くても全件を並べ替えない
+	query := fmt.Sprintf("SELECT s.%s FROM sessions s WHERE %s AND %s ORDER BY s.%s %s LIMIT 1 OFFSET ?",
+		column, where[0], where[1], column, order)
+	for _, p := range cfg.Distribution.Percentiles {
+		k := int64(math.Ceil(float64(count)*float64(100-p)/100)) - 1
+		if k < 0 {
+			k = 0
+		}
+		var value float64
+		if err := db.QueryRowContext(ctx, query, k).Scan(&value); err != nil {
+			return nil, err
+		}
+		percentiles["p"+strconv.Itoa(p)] = value
+	}
+	return result, nil
+}
+
+// GetDistribution: タグと並べ替えの項目（sort_by）ごとの値の分布とパーセンタイルを返す
+// 自分の順位（/ranks のrank）をcountで割ると「上位何%」になる
+func GetDistribution(cache *DistributionCache, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if len(cfg.Schema) == 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "Ranking is disabled"})
+		}
+		tag := c.Params("Tag")
+		if tag == "" {
+			tag = "global"
+		} else if len(cfg.SortableColumns[tag]) == 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "This tag's ranking is disabled"})
+		}
+
+		sortBy := c.Query("sort_by", cfg.SortableColumns[tag][0].Name)
+		column, currentSort, found := resolveSortKey(cfg, tag, sortBy)
+		if !found {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid sort key"})
+		}
+		field, _, ok := numericSchemaField(cfg, "", column)
+		if !ok {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("%s is not a number", sortBy)})
+		}
+
+		result, computedAt, err := cache.get(c.UserContext(), tag, column, currentSort.Order,
+			columnKind(cfg, field) == export.KindInt)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to compute distribution"})
+		}
+
+		// 次の再計算までは同じ結果になるため、クライアント側でもその間は保持してよい
+		refreshAt := computedAt.Add(time.Duration(cfg.Distribution.RefreshSeconds) * time.Second)
+		maxAge := int(time.Until(refreshAt).Seconds())
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		c.Set(fiber.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", maxAge))
+
+		response := fiber.Map{
+			"tag":         tag,
+			"sort_by":     sortBy,
+			"order":       currentSort.Order,
+			"computed_at": computedAt.UTC().Format(time.RFC3339),
+		}
+		for k, v := range result {
+			response[k] = v
+		}
+		return c.JSON(response)
+	}
+}
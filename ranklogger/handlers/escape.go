@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// 文字列はそのまま保存し、出力するときに用途に合わせてエスケープする
+// JSONはそのまま返し、Webページに直接埋め込む場合は ?escape=html を指定してもらう
+// エクスポート（CSVなど）は常にそのまま出力する
+
+// outputEscape: ?escape= の値を確認し、HTMLエスケープが必要かを返す
+func outputEscape(c *fiber.Ctx) (bool, error) {
+	switch c.Query("escape") {
+	case "":
+		return false, nil
+	case "html":
+		return true, nil
+	}
+	return false, fmt.Errorf("escape must be html")
+}
+
+// escapeHTMLValue: 値に含まれる文字列をすべてHTMLエスケープする（map, スライス, JSONの中も含む）
+func escapeHTMLValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case string:
+		return html.EscapeString(val)
+	case fiber.Map:
+		for k, item := range val {
+			val[k] = escapeHTMLValue(item)
+		}
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = escapeHTMLValue(item)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = escapeHTMLValue(item)
+		}
+	case []fiber.Map:
+		for _, item := range val {
+			escapeHTMLValue(item)
+		}
+	case json.RawMessage:
+		var decoded interface{}
+		if err := json.Unmarshal(val, &decoded); err != nil {
+			return val
+		}
+		return escapeHTMLValue(decoded)
+	}
+	return v
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+	"ranklogger/export"
+)
+
+// スキーマのTYPEから出力時の列の型を決める
+func columnKind(cfg *config.Config, field config.SchemaConfig) export.Kind {
+	if !slices.Contains(cfg.TypeValidation.Numbers, field.Type) {
+		return export.KindString
+	}
+	switch strings.ToUpper(field.Type) {
+	case "INTEGER", "INT":
+		return export.KindInt
+	}
+	return export.KindFloat
+}
+
+// tagCondition: 指定したタグの項目を1つでも持つセッションに絞り込む条件
+// タグ付きの項目は {TAG}_{NAME} としてdataに保存されているので、そのいずれかがNULLでないものを対象にする
+func tagCondition(cfg *config.Config, tag, dataColumn string) (string, bool) {
+	var conds []string
+	for _, field := range cfg.Schema {
+		if field.Tag == tag {
+			conds = append(conds, fmt.Sprintf("%s ->> '$.%s' IS NOT NULL", dataColumn, tag+"_"+field.Name))
+		}
+	}
+	if len(conds) == 0 {
+		return "", false
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", true
+}
+
+// 期間の絞り込み（since, until はRFC3339）
+func timeRange(c *fiber.Ctx, column string, where []string, args []interface{}) ([]string, []interface{}, error) {
+	for _, p := range []struct{ name, op string }{{"since", ">="}, {"until", "<"}} {
+		str := c.Query(p.name)
+		if str == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s format (use RFC3339)", p.name)
+		}
+		where = append(where, fmt.Sprintf("%s %s ?", column, p.op))
+		args = append(args, t)
+	}
+	return where, args, nil
+}
+
+// 出力形式のヘッダーを設定し、クエリ結果を1行ずつ書き出す
+// SetBodyStreamWriterの中はハンドラーが返った後に実行されるため、cは使わない
+func streamExport(c *fiber.Ctx, db *sql.DB, name, format string, columns []export.Column, query string, args []interface{}) error {
+	f := export.Formats[format]
+	filename := fmt.Sprintf("%s-%s.%s", name, time.Now().Format("20060102-150405"), f.Extension)
+	c.Set(fiber.HeaderContentType, f.ContentType)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		rows, err := db.QueryContext(context.Background(), query, args...)
+		if err != nil {
+			log.Printf("Export %s failed: %v", name, err)
+			return
+		}
+		defer rows.Close()
+
+		out, err := export.NewWriter(format, w, columns)
+		if err != nil {
+			log.Printf("Export %s failed: %v", name, err)
+			return
+		}
+
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		count := 0
+		for rows.Next() {
+			if err := rows.Scan(pointers...); err != nil {
+				log.Printf("Export %s failed: %v", name, err)
+				break
+			}
+			if err := out.WriteRow(values); err != nil {
+				// クライアントが切断した場合など
+				log.Printf("Export %s aborted: %v", name, err)
+				return
+			}
+			count++
+			// 途中経過を少しずつ送り出す
+			if count%1000 == 0 {
+				if err := w.Flush(); err != nil {
+					return
+				}
+			}
+		}
+		if err := out.Close(); err != nil {
+			log.Printf("Export %s failed: %v", name, err)
+		}
+		_ = w.Flush()
+	})
+	return nil
+}
+
+func exportFormat(c *fiber.Ctx) (string, error) {
+	format := strings.ToLower(c.Query("format", "csv"))
+	if _, ok := export.Formats[format]; !ok {
+		return "", fmt.Errorf("format must be one of csv, ndjson, parquet")
+	}
+	return format, nil
+}
+
+// ExportRecords: セッション（ランキングレコード）を全件ストリーミングで出力する（管理者用）
+// タグ指定なしの場合はすべての項目をDB上の名前で、タグ指定ありの場合はタグ無しとそのタグの項目を出力する
+func ExportRecords(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		format, err := exportFormat(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		tag := c.Params("Tag")
+
+		// 詳細情報の列
+		selectColumns := []string{"id", "uuid", "ip_address", "disable", "created_at", "played_at"}
+		columns := []export.Column{
+			{Name: "id", Kind: export.KindInt},
+			{Name: "uuid", Kind: export.KindString},
+			{Name: "ip_address", Kind: export.KindString},
+			{Name: "disable", Kind: export.KindBool},
+			{Name: "created_at", Kind: export.KindString},
+			{Name: "played_at", Kind: export.KindString},
+		}
+		if cfg.Server.EnablePlayCount {
+			selectColumns = append(selectColumns, "play_count")
+			columns = append(columns, export.Column{Name: "play_count", Kind: export.KindInt})
+		}
+
+		// スキーマの項目
+		for _, field := range cfg.Schema {
+			dbName := field.Name
+			if field.Tag != "" {
+				dbName = field.Tag + "_" + field.Name
+			}
+			outName := dbName
+			switch {
+			case tag == "":
+			case field.Tag == "":
+			case field.Tag == tag:
+				outName = field.Name
+			default:
+				continue
+			}
+			selectColumns = append(selectColumns, fmt.Sprintf("(data ->> '$.%s') AS %s", dbName, outName))
+			columns = append(columns, export.Column{Name: outName, Kind: columnKind(cfg, field)})
+		}
+
+		var where []string
+		var args []interface{}
+		if tag != "" {
+			cond, ok := tagCondition(cfg, tag, "data")
+			if !ok {
+				return c.Status(404).JSON(fiber.Map{"error": "Unknown tag"})
+			}
+			where = append(where, cond)
+		}
+		where, args, err = timeRange(c, "created_at", where, args)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if d := c.Query("disable"); d != "" {
+			disable, err := strconv.ParseBool(d)
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "disable must be true or false"})
+			}
+			where = append(where, "disable = ?")
+			args = append(args, disable)
+		}
+
+		query := fmt.Sprintf("SELECT %s FROM sessions", strings.Join(selectColumns, ", "))
+		if len(where) > 0 {
+			query += " WHERE " + strings.Join(where, " AND ")
+		}
+		query += " ORDER BY id ASC"
+
+		name := "records"
+		if tag != "" {
+			name += "-" + tag
+		}
+		return streamExport(c, db, name, format, columns, query, args)
+	}
+}
+
+// ExportLogs: ログを全件ストリーミングで出力する（管理者用）
+func ExportLogs(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		format, err := exportFormat(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		// dataは種類ごとに項目が異なるため、JSONの文字列として1列で出力する（インポートでも同じ形式で読める）
+		selectColumns := []string{"l.id", "l.session_id", "s.uuid", "l.type", "l.content", "json(l.data)", "l.created_at"}
+		columns := []export.Column{
+			{Name: "id", Kind: export.KindInt},
+			{Name: "session_id", Kind: export.KindInt},
+			{Name: "uuid", Kind: export.KindString},
+			{Name: "type", Kind: export.KindInt},
+			{Name: "content", Kind: export.KindString},
+			{Name: "data", Kind: export.KindString},
+			{Name: "created_at", Kind: export.KindString},
+		}
+		if cfg.Server.EnablePlayCount {
+			selectColumns = append(selectColumns, "s.play_count")
+			columns = append(columns, export.Column{Name: "play_count", Kind: export.KindInt})
+		}
+
+		var where []string
+		var args []interface{}
+		if sessionId := c.QueryInt("session_id", 0); sessionId != 0 {
+			where = append(where, "l.session_id = ?")
+			args = append(args, sessionId)
+		}
+		logTypes, err := parseLogTypes(c, cfg)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if len(logTypes) > 0 {
+			cond, typeArgs := logTypeCondition("l.type", logTypes)
+			where = append(where, cond)
+			args = append(args, typeArgs...)
+		}
+		if tag := c.Query("tag"); tag != "" {
+			cond, ok := tagCondition(cfg, tag, "s.data")
+			if !ok {
+				return c.Status(404).JSON(fiber.Map{"error": "Unknown tag"})
+			}
+			where = append(where, cond)
+		}
+		if d := c.Query("disable"); d != "" {
+			disable, err := strconv.ParseBool(d)
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "disable must be true or false"})
+			}
+			where = append(where, "s.disable = ?")
+			args = append(args, disable)
+		}
+		where, args, err = timeRange(c, "l.created_at", where, args)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		query := fmt.Sprintf("SELECT %s FROM logs l JOIN sessions s ON s.id = l.session_id", strings.Join(selectColumns, ", "))
+		if len(where) > 0 {
+			query += " WHERE " + strings.Join(where, " AND ")
+		}
+		query += " ORDER BY l.id ASC"
+
+		return streamExport(c, db, "logs", format, columns, query, args)
+	}
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+	"ranklogger/filter"
+)
+
+// 不適切な表現が含まれていたときの対応（RECORD_SCHEMAのFILTERとCONTENT_FILTERの各POLICY）
+const (
+	filterReject  = "reject"  // 登録を拒否する
+	filterMask    = "mask"    // 該当部分を伏せ字にして登録する
+	filterDisable = "disable" // そのまま登録し、レコード（セッション）を無効化する
+)
+
+// filterText: 1つの文字列にフィルターを適用し、保存する文字列と無効化が必要かを返す
+func filterText(f *filter.Filter, policy, name, s string) (string, bool, error) {
+	if policy == "" {
+		return s, false, nil
+	}
+	masked, hit := f.Check(s)
+	if !hit {
+		return s, false, nil
+	}
+	switch policy {
+	case filterReject:
+		return "", false, fmt.Errorf("%s contains inappropriate content", name)
+	case filterMask:
+		return masked, false, nil
+	}
+	return s, true, nil
+}
+
+// filterRecordData: FILTERを設定した項目を検査する（送られたdataをそのまま書き換える）
+// disableの項目に該当した場合はtrueを返す
+func filterRecordData(cfg *config.Config, f *filter.Filter, tag string, data map[string]interface{}) (bool, error) {
+	disable := false
+	for _, field := range cfg.Schema {
+		if field.Filter == "" || (field.Tag != "" && field.Tag != tag) {
+			continue
+		}
+		// 文字列でない場合は、この後のvalidateRecordDataでエラーになる
+		str, ok := data[field.Name].(string)
+		if !ok {
+			continue
+		}
+		filtered, flagged, err := filterText(f, field.Filter, field.Name, str)
+		if err != nil {
+			return false, err
+		}
+		data[field.Name] = filtered
+		disable = disable || flagged
+	}
+	return disable, nil
+}
+
+// filterLogData: ログの構造化データのうち、FILTERを設定した項目を検査する（送られたdataをそのまま書き換える）
+// disableの項目に該当した場合はtrueを返す
+func filterLogData(f *filter.Filter, fields []config.SchemaConfig, data map[string]interface{}) (bool, error) {
+	disable := false
+	for _, field := range fields {
+		if field.Filter == "" {
+			continue
+		}
+		// 文字列でない場合は、この後のvalidateLogDataでエラーになる
+		str, ok := data[field.Name].(string)
+		if !ok {
+			continue
+		}
+		filtered, flagged, err := filterText(f, field.Filter, field.Name, str)
+		if err != nil {
+			return false, err
+		}
+		data[field.Name] = filtered
+		disable = disable || flagged
+	}
+	return disable, nil
+}
+
+// ReloadFilter: 単語リストと正規表現リストを読み込み直す（管理者用）
+func ReloadFilter(f *filter.Filter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		stats, err := f.Reload()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": fmt.Sprintf("Failed to reload filter: %v", err)})
+		}
+		return c.JSON(fiber.Map{
+			"message":  "Filter reloaded",
+			"words":    stats.Words,
+			"patterns": stats.Patterns,
+		})
+	}
+}
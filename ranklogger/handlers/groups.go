@@ -0,0 +1,549 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+	"ranklogger/filter"
+	"ranklogger/models"
+)
+
+// プレイヤーのグループと、グループ内のランキング
+// グループは管理者（/groups/admin）またはプレイヤー（/groups）が作成する
+// プレイヤーが変更・削除できるのは、owner_uuidが一致する自分のグループだけ（管理者のグループは変更できない）
+// UUIDはプレイヤー本人であることの確認に使うため、プレイヤー向けのレスポンスには含めない
+// （グループの内容とランキングは、?uuid= で指定したプレイヤーがメンバーの場合のみ返す）
+
+var (
+	errGroupNotFound = errors.New("Group not found")
+	errGroupNotOwner = errors.New("Only the owner can modify this group")
+)
+
+// groupMembers: メンバーのUUID（追加した順）
+func groupMembers(ctx context.Context, db *sql.DB, id int64) ([]string, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT uuid FROM player_group_members WHERE group_id = ? ORDER BY created_at, rowid", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uuids := []string{}
+	for rows.Next() {
+		var uuid string
+		if err := rows.Scan(&uuid); err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, uuid)
+	}
+	return uuids, rows.Err()
+}
+
+// isGroupMember: uuidのプレイヤーがグループのメンバーか
+func isGroupMember(ctx context.Context, db *sql.DB, id int64, uuid string) (bool, error) {
+	var member bool
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) > 0 FROM player_group_members WHERE group_id = ? AND uuid = ?", id, uuid).Scan(&member)
+	return member, err
+}
+
+// groupViewer: プレイヤー向けの取得で、?uuid= のプレイヤーがメンバーかを確認する
+// メンバーでない場合はグループがない場合と同じく404にする（IDからグループの有無を知られないようにする）
+func groupViewer(c *fiber.Ctx, db *sql.DB, id int64) (string, int, error) {
+	uuid := c.Query("uuid")
+	if err := validate.Var(uuid, "required,uuid4"); err != nil {
+		return "", 400, fmt.Errorf("uuid is required")
+	}
+	member, err := isGroupMember(c.UserContext(), db, id, uuid)
+	if err != nil {
+		return "", 500, fmt.Errorf("Failed to fetch group")
+	}
+	if !member {
+		return "", 404, errGroupNotFound
+	}
+	return uuid, 0, nil
+}
+
+// groupParam: パスのグループID
+func groupParam(c *fiber.Ctx) (int64, error) {
+	id, err := strconv.ParseInt(c.Params("GroupId"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("Invalid group id")
+	}
+	return id, nil
+}
+
+// parseGroupRequest: 作成・変更の内容を確認する
+// プレイヤーの場合はowner_uuidが必須で、名前はCONTENT_FILTER:DISPLAY_NAME_POLICYに従う
+func parseGroupRequest(c *fiber.Ctx, cfg *config.Config, contentFilter *filter.Filter, admin bool) (models.GroupRequest, error) {
+	var input models.GroupRequest
+	if err := c.BodyParser(&input); err != nil {
+		return input, fmt.Errorf("Invalid JSON")
+	}
+	if err := validate.Struct(input); err != nil {
+		return input, err
+	}
+	if !admin {
+		if input.OwnerUUID == "" {
+			return input, fmt.Errorf("owner_uuid is required")
+		}
+		name, _, err := filterText(contentFilter, cfg.ContentFilter.DisplayNamePolicy, "name", input.Name)
+		if err != nil {
+			return input, err
+		}
+		input.Name = name
+	}
+	return input, nil
+}
+
+// groupMemberList: メンバーの重複を除き、作成者を先頭に含める（作成者はグループから外せない）
+func groupMemberList(cfg *config.Config, owner string, uuids []string) ([]string, error) {
+	var members []string
+	if owner != "" {
+		members = append(members, owner)
+	}
+	for _, uuid := range uuids {
+		if !slices.Contains(members, uuid) {
+			members = append(members, uuid)
+		}
+	}
+	if len(members) > cfg.Groups.MaxMembers {
+		return nil, fmt.Errorf("A group can have at most %d members", cfg.Groups.MaxMembers)
+	}
+	return members, nil
+}
+
+// replaceGroupMembers: メンバーを入れ替える（残ったメンバーの追加日時は変えない）
+func replaceGroupMembers(ctx context.Context, q queryer, id int64, members []string) error {
+	uuids, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx,
+		"DELETE FROM player_group_members WHERE group_id = ? AND uuid NOT IN (SELECT value FROM json_each(?))",
+		id, string(uuids))
+	if err != nil {
+		return err
+	}
+	// json_eachは配列の順に返すため、追加した順が保たれる
+	_, err = q.ExecContext(ctx, `
+		INSERT INTO player_group_members (group_id, uuid)
+		SELECT ?, value FROM json_each(?) WHERE true
+		ON CONFLICT(group_id, uuid) DO NOTHING`, id, string(uuids))
+	return err
+}
+
+// checkGroupOwner: グループがあり、プレイヤーが変更できるかを確認し、作成者を返す（管理者は常に変更できる）
+func checkGroupOwner(ctx context.Context, q queryer, id int64, ownerUUID string, admin bool) (string, error) {
+	var owner sql.NullString
+	err := q.QueryRowContext(ctx, "SELECT owner_uuid FROM player_groups WHERE id = ?", id).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return "", errGroupNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if !admin && (!owner.Valid || owner.String != ownerUUID) {
+		return "", errGroupNotOwner
+	}
+	return owner.String, nil
+}
+
+// groupErrorStatus: checkGroupOwnerのエラーのステータスコード
+func groupErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errGroupNotFound):
+		return 404
+	case errors.Is(err, errGroupNotOwner):
+		return 403
+	}
+	return 500
+}
+
+// fetchGroup: グループの情報とメンバー（プロフィールがあれば含める）
+// 管理者以外には、UUIDの代わりにviewer（取得したプレイヤー）が作成者か、各メンバーが作成者かを返す
+func fetchGroup(ctx context.Context, db *sql.DB, id int64, viewer string, admin bool) (fiber.Map, error) {
+	var name string
+	var owner sql.NullString
+	var createdAt, updatedAt interface{}
+	err := db.QueryRowContext(ctx,
+		"SELECT name, owner_uuid, created_at, updated_at FROM player_groups WHERE id = ?", id).
+		Scan(&name, &owner, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT m.uuid, (SELECT %s FROM players WHERE players.uuid = m.uuid)
+		FROM player_group_members m WHERE m.group_id = ? ORDER BY m.created_at, m.rowid`, playerObjectColumns), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []fiber.Map{}
+	for rows.Next() {
+		var uuid string
+		var player sql.NullString
+		if err := rows.Scan(&uuid, &player); err != nil {
+			return nil, err
+		}
+		var profile interface{} // プロフィールを登録していないプレイヤーはnull
+		if player.Valid {
+			profile = json.RawMessage(player.String)
+		}
+		member := fiber.Map{"player": profile, "is_owner": owner.Valid && uuid == owner.String}
+		if admin {
+			member["uuid"] = uuid
+		}
+		members = append(members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	group := fiber.Map{
+		"id":         id,
+		"name":       name,
+		"members":    members,
+		"created_at": createdAt,
+		"updated_at": updatedAt,
+	}
+	if admin {
+		var ownerUUID interface{}
+		if owner.Valid {
+			ownerUUID = owner.String
+		}
+		group["owner_uuid"] = ownerUUID
+	} else {
+		group["is_owner"] = owner.Valid && viewer == owner.String
+	}
+	return group, nil
+}
+
+// CreateGroup: グループの作成（プレイヤーの場合、作成者は自動的にメンバーになる）
+func CreateGroup(db *sql.DB, cfg *config.Config, contentFilter *filter.Filter, admin bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input, err := parseGroupRequest(c, cfg, contentFilter, admin)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		members, err := groupMemberList(cfg, input.OwnerUUID, input.UUIDs)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		ctx := c.UserContext()
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Transaction failed"})
+		}
+		defer tx.Rollback()
+
+		// 1人のプレイヤーが作成できる数の上限
+		if !admin {
+			var owned int
+			err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM player_groups WHERE owner_uuid = ?", input.OwnerUUID).Scan(&owned)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to create group"})
+			}
+			if owned >= cfg.Groups.MaxGroupsPerOwner {
+				return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("A player can create at most %d groups", cfg.Groups.MaxGroupsPerOwner)})
+			}
+		}
+
+		var owner interface{}
+		if input.OwnerUUID != "" {
+			owner = input.OwnerUUID
+		}
+		var id int64
+		err = tx.QueryRowContext(ctx, "INSERT INTO player_groups (name, owner_uuid) VALUES (?, ?) RETURNING id",
+			input.Name, owner).Scan(&id)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create group"})
+		}
+		if err := replaceGroupMembers(ctx, tx, id, members); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create group"})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+
+		group, err := fetchGroup(ctx, db, id, input.OwnerUUID, admin)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch group"})
+		}
+		return c.Status(201).JSON(fiber.Map{
+			"message": "Group created successfully",
+			"group":   group,
+		})
+	}
+}
+
+// UpdateGroup: グループの名前とメンバーの変更（uuidsはメンバー全員を指定する）
+// 作成者は変更できず、メンバーからも外れない。管理者の場合、owner_uuidは使わない
+func UpdateGroup(db *sql.DB, cfg *config.Config, contentFilter *filter.Filter, admin bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := groupParam(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		input, err := parseGroupRequest(c, cfg, contentFilter, admin)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		ctx := c.UserContext()
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Transaction failed"})
+		}
+		defer tx.Rollback()
+
+		owner, err := checkGroupOwner(ctx, tx, id, input.OwnerUUID, admin)
+		if err != nil {
+			status := groupErrorStatus(err)
+			if status == 500 {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to update group"})
+			}
+			return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+		}
+		members, err := groupMemberList(cfg, owner, input.UUIDs)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"UPDATE player_groups SET name = ?, updated_at = datetime('now', 'localtime') WHERE id = ?", input.Name, id)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update group"})
+		}
+		if err := replaceGroupMembers(ctx, tx, id, members); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update group"})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+
+		group, err := fetchGroup(ctx, db, id, input.OwnerUUID, admin)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch group"})
+		}
+		return c.JSON(fiber.Map{
+			"message": "Group updated successfully",
+			"group":   group,
+		})
+	}
+}
+
+// DeleteGroup: グループの削除（プレイヤーの場合は ?owner_uuid= で作成者を指定する）
+func DeleteGroup(db *sql.DB, admin bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := groupParam(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		ownerUUID := c.Query("owner_uuid")
+		if !admin {
+			if err := validate.Var(ownerUUID, "required,uuid4"); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "owner_uuid is required"})
+			}
+		}
+		ctx := c.UserContext()
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Transaction failed"})
+		}
+		defer tx.Rollback()
+
+		if _, err := checkGroupOwner(ctx, tx, id, ownerUUID, admin); err != nil {
+			status := groupErrorStatus(err)
+			if status == 500 {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to delete group"})
+			}
+			return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM player_group_members WHERE group_id = ?", id); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to delete group"})
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM player_groups WHERE id = ?", id); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to delete group"})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{
+			"message": "Group deleted successfully",
+			"id":      id,
+		})
+	}
+}
+
+// GetGroup: グループの情報とメンバー（プレイヤーは ?uuid= で指定した本人がメンバーの場合のみ）
+func GetGroup(db *sql.DB, admin bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := groupParam(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		escape, err := outputEscape(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		var viewer string
+		if !admin {
+			var status int
+			viewer, status, err = groupViewer(c, db, id)
+			if err != nil {
+				return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+		group, err := fetchGroup(c.UserContext(), db, id, viewer, admin)
+		if errors.Is(err, errGroupNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch group"})
+		}
+		// Webページに直接埋め込む場合のHTMLエスケープ
+		if escape {
+			escapeHTMLValue(group)
+		}
+		return c.JSON(group)
+	}
+}
+
+// ListGroups: グループの一覧（新しい順）
+// プレイヤーは ?uuid= で自分が所属しているグループを取得する。管理者はuuid, owner_uuidで絞り込める（省略するとすべて）
+func ListGroups(db *sql.DB, cfg *config.Config, admin bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		uuid := c.Query("uuid")
+		if !admin {
+			if err := validate.Var(uuid, "required,uuid4"); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "uuid is required"})
+			}
+		}
+		escape, err := outputEscape(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		limit := c.QueryInt("limit", 50)
+		offset := c.QueryInt("offset", 0)
+		if limit <= 0 || offset < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "limit must be positive and offset must not be negative"})
+		}
+		// 最大値の制限（負荷対策）
+		if limit > cfg.Server.ReadLimit {
+			limit = cfg.Server.ReadLimit
+		}
+
+		query := `
+			SELECT g.id, g.name, g.owner_uuid,
+				(SELECT COUNT(*) FROM player_group_members m WHERE m.group_id = g.id),
+				g.created_at, g.updated_at
+			FROM player_groups g WHERE 1 = 1`
+		var args []interface{}
+		if uuid != "" {
+			query += " AND g.id IN (SELECT group_id FROM player_group_members WHERE uuid = ?)"
+			args = append(args, uuid)
+		}
+		if owner := c.Query("owner_uuid"); admin && owner != "" {
+			query += " AND g.owner_uuid = ?"
+			args = append(args, owner)
+		}
+		query += " ORDER BY g.id DESC LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+
+		rows, err := db.QueryContext(c.UserContext(), query, args...)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch groups"})
+		}
+		defer rows.Close()
+
+		groups := []fiber.Map{}
+		for rows.Next() {
+			var id int64
+			var name string
+			var memberCount int
+			var owner sql.NullString
+			var createdAt, updatedAt interface{}
+			if err := rows.Scan(&id, &name, &owner, &memberCount, &createdAt, &updatedAt); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch groups"})
+			}
+			group := fiber.Map{
+				"id":           id,
+				"name":         name,
+				"member_count": memberCount,
+				"created_at":   createdAt,
+				"updated_at":   updatedAt,
+			}
+			// プレイヤーには作成者のUUIDを返さない
+			if admin {
+				var ownerUUID interface{}
+				if owner.Valid {
+					ownerUUID = owner.String
+				}
+				group["owner_uuid"] = ownerUUID
+			} else {
+				group["is_owner"] = owner.Valid && uuid == owner.String
+			}
+			groups = append(groups, group)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch groups"})
+		}
+		if escape {
+			escapeHTMLValue(groups)
+		}
+		return c.JSON(fiber.Map{"groups": groups})
+	}
+}
+
+// GetGroupRecords: グループのメンバーだけのランキング（クエリと返す内容は /records と同じ）
+// ?uuid= で指定した本人がメンバーの場合のみ返す
+func GetGroupRecords(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := groupParam(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if _, status, err := groupViewer(c, db, id); err != nil {
+			return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+		}
+		members, err := groupMembers(c.UserContext(), db, id)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch group"})
+		}
+		return respondRanking(c, db, cfg, false, members)
+	}
+}
+
+// PostLeaderboard: 指定したプレイヤー（uuids）だけのランキング（フレンドなど、グループを作成せずに使う）
+// 並べ替えなどはクエリで指定し、返す内容は /records と同じ
+func PostLeaderboard(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var input models.LeaderboardRequest
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON"})
+		}
+		if err := validate.Struct(input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if len(input.UUIDs) > cfg.Groups.MaxMembers {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("uuids can contain at most %d players", cfg.Groups.MaxMembers)})
+		}
+		return respondRanking(c, db, cfg, false, input.UUIDs)
+	}
+}
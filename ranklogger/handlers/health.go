@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"database/sql"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+	"ranklogger/database"
+)
+
+// ビルド時に -ldflags "-X ranklogger/handlers.BuildCommit=$(git rev-parse HEAD)" で埋め込む
+// 埋め込まれていない場合は、Goのビルド情報（vcs.revision）を使う
+var BuildCommit = ""
+
+var startedAt = time.Now()
+
+// サーバーの稼働状態（終了処理中かどうか）
+type ServerState struct {
+	shuttingDown atomic.Bool
+}
+
+func (s *ServerState) SetShuttingDown() {
+	s.shuttingDown.Store(true)
+}
+
+func (s *ServerState) ShuttingDown() bool {
+	return s.shuttingDown.Load()
+}
+
+// Healthz: プロセスが生きていることだけを返す（DBなどは確認しない）
+func Healthz() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": "ok"})
+	}
+}
+
+// Readyz: リクエストを受け付けられる状態かを確認する
+// いずれかのチェックに失敗した場合は503を返す
+func Readyz(db *sql.DB, cfg *config.Config, state *ServerState) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		checks := fiber.Map{}
+		ready := true
+		fail := func(name string, reason interface{}) {
+			checks[name] = reason
+			ready = false
+		}
+
+		// 1. 終了処理中でないか
+		if state.ShuttingDown() {
+			fail("shutdown", "shutting down")
+		} else {
+			checks["shutdown"] = "ok"
+		}
+
+		// 2. DBに接続できるか
+		var one int
+		if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+			fail("database", err.Error())
+		} else {
+			checks["database"] = "ok"
+		}
+
+		// 3. WALファイルが肥大化していないか（チェックポイントが進んでいない）
+		if info, err := os.Stat(cfg.Server.DBPath + "-wal"); err == nil {
+			sizeMB := float64(info.Size()) / 1024 / 1024
+			if cfg.Health.MaxWALSizeMB > 0 && sizeMB > float64(cfg.Health.MaxWALSizeMB) {
+				fail("wal", fiber.Map{"size_mb": sizeMB, "limit_mb": cfg.Health.MaxWALSizeMB})
+			} else {
+				checks["wal"] = "ok"
+			}
+		} else {
+			checks["wal"] = "ok" // WALファイルがまだない
+		}
+
+		// 4. マイグレーションと仮想列の作成が済んでいるか
+		pending, err := database.PendingMigrations(ctx, db)
+		if err != nil {
+			fail("migrations", err.Error())
+		} else if len(pending) > 0 {
+			fail("migrations", fiber.Map{"pending": pending})
+		} else if missing, err := database.MissingColumns(ctx, db, cfg); err != nil {
+			fail("migrations", err.Error())
+		} else if len(missing) > 0 {
+			fail("migrations", fiber.Map{"missing_columns": missing})
+		} else {
+			checks["migrations"] = "ok"
+		}
+
+		status := "ready"
+		if !ready {
+			status = "not ready"
+			c.Status(503)
+		}
+		return c.JSON(fiber.Map{
+			"status": status,
+			"checks": checks,
+		})
+	}
+}
+
+// GetVersion: ビルド情報・スキーマのハッシュ・設定の概要を返す（管理者用）
+// パスワードやAPIキーなどの秘密情報は含めない
+func GetVersion(db *sql.DB, cfg *config.Config) fiber.Handler {
+	commit := BuildCommit
+	modified := false
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if commit == "" {
+					commit = s.Value
+				}
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+
+	return func(c *fiber.Ctx) error {
+		schemaHash, err := database.SchemaHash(c.UserContext(), db)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to compute schema hash"})
+		}
+
+		var fields []string
+		for _, field := range cfg.Schema {
+			if field.Tag != "" {
+				fields = append(fields, field.Tag+"_"+field.Name)
+			} else {
+				fields = append(fields, field.Name)
+			}
+		}
+
+		return c.JSON(fiber.Map{
+			"build": fiber.Map{
+				"commit":     commit,
+				"modified":   modified,
+				"go_version": runtime.Version(),
+			},
+			"started_at":  startedAt.Format(time.RFC3339),
+			"schema_hash": schemaHash,
+			"config": fiber.Map{
+				"api_root_path":      cfg.Server.APIRootPath,
+				"read_limit":         cfg.Server.ReadLimit,
+				"enable_play_count":  cfg.Server.EnablePlayCount,
+				"log_retention_days": cfg.Retention.LogRetentionDays,
+				"record_fields":      fields,
+				"sortable_columns":   cfg.SortableColumns,
+				"user_limit":         cfg.Limits.UserLimit,
+				"audit_log_output":   cfg.AuditLog.Output,
+				"tracing_enabled":    cfg.Tracing.Enabled,
+			},
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+	"ranklogger/events"
+	"ranklogger/middleware"
+	"ranklogger/models"
+)
+
+// recordSubmission: 送信履歴（record_submissions）に1件追記する
+// resultには登録後のsessionsの内容（MERGE後のdata）をそのまま保存する
+func recordSubmission(ctx context.Context, q queryer, sessionId int64, payload, ip, idemKey, source, createdAt string) error {
+	var key, created interface{}
+	if idemKey != "" {
+		key = idemKey
+	}
+	if createdAt != "" {
+		created = createdAt
+	}
+	_, err := q.ExecContext(ctx, `
+		INSERT INTO record_submissions (session_id, payload, result, ip_address, idempotency_key, source, played_at, created_at)
+		SELECT id, jsonb(?), data, ?, ?, ?, played_at, COALESCE(?, datetime('now', 'localtime'))
+		FROM sessions WHERE id = ?`,
+		payload, ip, key, source, created, sessionId)
+	return err
+}
+
+// GetRecordHistory: セッションの送信履歴を古い順に取得する（管理者用）
+func GetRecordHistory(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		sessionId, err := c.ParamsInt("SessionId")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid session id"})
+		}
+
+		// ページネーション設定
+		limit := c.QueryInt("limit", 100)
+		offset := c.QueryInt("offset", 0)
+		if limit <= 0 || offset < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "limit must be positive and offset must not be negative"})
+		}
+		// 最大値の制限（負荷対策）
+		if limit > cfg.Server.ReadLimit {
+			limit = cfg.Server.ReadLimit
+		}
+		escape, err := outputEscape(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		ctx := c.UserContext()
+
+		var exists int
+		if err := db.QueryRowContext(ctx, "SELECT 1 FROM sessions WHERE id = ?", sessionId).Scan(&exists); err != nil {
+			if err == sql.ErrNoRows {
+				return c.Status(404).JSON(fiber.Map{"error": "Session not found"})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch history"})
+		}
+
+		rows, err := db.QueryContext(ctx, `
+			SELECT id, source, json(payload), json(result), ip_address, idempotency_key, played_at, created_at
+			FROM record_submissions WHERE session_id = ?
+			ORDER BY id ASC LIMIT ? OFFSET ?`, sessionId, limit, offset)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch history"})
+		}
+		defer rows.Close()
+
+		submissions := []fiber.Map{}
+		for rows.Next() {
+			var id int64
+			var source, payload, result string
+			var ip, key, playedAt, createdAt interface{} // NULLはnullとして返す
+			if err := rows.Scan(&id, &source, &payload, &result, &ip, &key, &playedAt, &createdAt); err != nil {
+				continue
+			}
+			submissions = append(submissions, fiber.Map{
+				"id":              id,
+				"source":          source,
+				"payload":         json.RawMessage(payload),
+				"result":          json.RawMessage(result),
+				"ip_address":      ip,
+				"idempotency_key": key,
+				"played_at":       playedAt,
+				"created_at":      createdAt,
+			})
+		}
+
+		// Webページに直接埋め込む場合のHTMLエスケープ
+		if escape {
+			escapeHTMLValue(submissions)
+		}
+
+		return c.JSON(fiber.Map{
+			"session_id":  sessionId,
+			"submissions": submissions,
+		})
+	}
+}
+
+// RollbackRecord: セッションのdataを、指定した送信履歴の時点（登録後の内容）に戻す（管理者用）
+// 戻した操作も送信履歴に追記されるため、さらに元に戻すこともできる
+func RollbackRecord(db *sql.DB, cfg *config.Config, broker *events.Broker) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		sessionId, err := c.ParamsInt("SessionId")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid session id"})
+		}
+
+		var req models.RollbackRecordRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON"})
+		}
+		if err := validate.Struct(req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		ctx := c.UserContext()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Transaction start failed"})
+		}
+		defer tx.Rollback()
+
+		// 別のセッションの履歴は指定できない
+		result, err := tx.ExecContext(ctx, `
+			UPDATE sessions SET
+				data = r.result,
+				played_at = r.played_at
+			FROM (SELECT result, played_at FROM record_submissions WHERE id = ? AND session_id = ?) AS r
+			WHERE sessions.id = ?`,
+			req.SubmissionID, sessionId, sessionId)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to rollback record"})
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "Submission not found"})
+		}
+
+		var data string
+		if err := tx.QueryRowContext(ctx, "SELECT json(data) FROM sessions WHERE id = ?", sessionId).Scan(&data); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to rollback record"})
+		}
+
+		// 戻した内容を送信履歴に残す
+		if err := recordSubmission(ctx, tx, int64(sessionId), data, middleware.GetTrustedIP(c, cfg), "", sourceRollback, ""); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to rollback record"})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		broker.Publish(events.TopicRecords, events.RecordEvent{Action: sourceRollback, SessionID: int64(sessionId)})
+
+		return c.JSON(fiber.Map{
+			"message":       "Record rolled back",
+			"session_id":    sessionId,
+			"submission_id": req.SubmissionID,
+			"data":          json.RawMessage(data),
+		})
+	}
+}
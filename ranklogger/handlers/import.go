@@ -0,0 +1,503 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+	"ranklogger/events"
+	"ranklogger/export"
+	"ranklogger/models"
+)
+
+// インポートでエラーになった行
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ImportReport: インポートの結果（エラーになった行は登録せずに続行する）
+type ImportReport struct {
+	Format          string        `json:"format"`
+	Total           int           `json:"total"`
+	Imported        int           `json:"imported"`
+	Failed          int           `json:"failed"`
+	Errors          []ImportError `json:"errors"`
+	ErrorsTruncated bool          `json:"errors_truncated,omitempty"`
+}
+
+func (r *ImportReport) fail(cfg *config.Config, line int, err error) {
+	r.Failed++
+	if len(r.Errors) >= cfg.Import.MaxErrors {
+		r.ErrorsTruncated = true
+		return
+	}
+	r.Errors = append(r.Errors, ImportError{Line: line, Error: err.Error()})
+}
+
+// 検証済みで登録待ちの行
+type pendingRow[T any] struct {
+	line int
+	row  T
+}
+
+// インポートの対象ごとの処理（検証と登録）
+type importer[T any] struct {
+	kinds map[string]export.Kind                             // CSVの値をどの型として読むか
+	parse func(row map[string]interface{}) (T, error)        // 1行分の検証
+	apply func(ctx context.Context, tx *sql.Tx, row T) error // 1行分の登録
+}
+
+// runImport: 1行ずつ読み取って検証し、BATCH_SIZE行ごとに1トランザクションで登録する
+func runImport[T any](ctx context.Context, db *sql.DB, cfg *config.Config, format string, r io.Reader, imp importer[T]) (*ImportReport, error) {
+	report := &ImportReport{Format: format, Errors: []ImportError{}}
+	var batch []pendingRow[T]
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		imported := 0
+		for _, p := range batch {
+			// 1行で複数の文を実行するため、行ごとにセーブポイントを置き、失敗した行の変更だけを取り消して続行する
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT import_row"); err != nil {
+				return err
+			}
+			applyErr := imp.apply(ctx, tx, p.row)
+			if applyErr != nil {
+				if _, err := tx.ExecContext(ctx, "ROLLBACK TO import_row"); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.ExecContext(ctx, "RELEASE import_row"); err != nil {
+				return err
+			}
+			if applyErr != nil {
+				report.fail(cfg, p.line, applyErr)
+				continue
+			}
+			imported++
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		report.Imported += imported
+		batch = batch[:0]
+		return nil
+	}
+
+	err := readImportRows(format, r, imp.kinds, func(line int, m map[string]interface{}, err error) error {
+		report.Total++
+		if err != nil {
+			report.fail(cfg, line, err)
+			return nil
+		}
+		row, err := imp.parse(m)
+		if err != nil {
+			report.fail(cfg, line, err)
+			return nil
+		}
+		batch = append(batch, pendingRow[T]{line, row})
+		if len(batch) >= cfg.Import.BatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return report, err
+}
+
+// readImportRows: NDJSONまたはCSVを1行ずつmapとして読み取る
+// CSVは1行目をヘッダーとして扱い、空のセルは値なしとする
+func readImportRows(format string, r io.Reader, kinds map[string]export.Kind, fn func(line int, row map[string]interface{}, err error) error) error {
+	switch format {
+	case "ndjson":
+		br := bufio.NewReader(r)
+		for line := 1; ; line++ {
+			b, err := br.ReadBytes('\n')
+			if len(bytes.TrimSpace(b)) > 0 {
+				var row map[string]interface{}
+				parseErr := json.Unmarshal(b, &row)
+				if parseErr != nil {
+					parseErr = fmt.Errorf("invalid JSON: %v", parseErr)
+				} else if row == nil {
+					parseErr = fmt.Errorf("each line must be a JSON object")
+				}
+				if err := fn(line, row, parseErr); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+	case "csv":
+		cr := csv.NewReader(r)
+		header, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				return nil
+			}
+			// 読み取れなかった行はFieldPosで位置を取れないため、エラーの開始行を使う
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				if err := fn(parseErr.StartLine, nil, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			line, _ := cr.FieldPos(0)
+
+			row := make(map[string]interface{}, len(header))
+			var convErr error
+			for i, name := range header {
+				if record[i] == "" {
+					continue
+				}
+				if row[name], err = parseCSVValue(record[i], kinds[name]); err != nil && convErr == nil {
+					convErr = fmt.Errorf("%s: %v", name, err)
+				}
+			}
+			if convErr != nil {
+				row = nil
+			}
+			if err := fn(line, row, convErr); err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("unknown format: %s", format)
+}
+
+// CSVのセルをJSONで受け取った場合と同じ型に変換する（数値はfloat64）
+func parseCSVValue(s string, kind export.Kind) (interface{}, error) {
+	switch kind {
+	case export.KindInt, export.KindFloat:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return f, nil
+	case export.KindBool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("must be true or false")
+		}
+		return b, nil
+	}
+	return s, nil
+}
+
+// mapをJSONのタグに従ってstructに変換する（型が違う場合はエラー）
+func decodeRow(m map[string]interface{}, v interface{}) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("%s must be %s", typeErr.Field, typeErr.Type)
+		}
+		return err
+	}
+	return nil
+}
+
+// parseImportTime: RFC3339、またはDBと同じ形式（YYYY-MM-DD HH:MM:SS、サーバーのローカル時刻）を受け付ける
+// DBにはローカル時刻の文字列として保存されているので、その形式に揃える
+func parseImportTime(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.ParseInLocation(time.DateTime, s, time.Local)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid created_at format (use RFC3339 or YYYY-MM-DD HH:MM:SS)")
+	}
+	return t.In(time.Local).Format(time.DateTime), nil
+}
+
+func importFormat(format string) (string, error) {
+	format = strings.ToLower(format)
+	if format != "ndjson" && format != "csv" {
+		return "", fmt.Errorf("format must be ndjson or csv")
+	}
+	return format, nil
+}
+
+// レコードのインポートで、data以外に使う項目
+var importRecordMeta = []string{"uuid", "play_count", "ip_address", "created_at", "played_at", "disable", "id"}
+
+// ImportRecords: 過去のレコードを一括で登録する
+// 各行は PostRecord と同じ検証（RECORD_SCHEMA）を行い、created_at, played_at, ip_address, disable を指定できる
+// NDJSONでdataがない行と、CSVの行は、上記以外の項目をdataとして扱う（エクスポートしたファイルをそのまま使える）
+func ImportRecords(ctx context.Context, db *sql.DB, cfg *config.Config, tag, format string, r io.Reader) (*ImportReport, error) {
+	if tag != "" {
+		if _, ok := tagCondition(cfg, tag, "data"); !ok {
+			return nil, fmt.Errorf("unknown tag: %s", tag)
+		}
+	}
+
+	// play_countタグのバリデーション追加
+	validate.RegisterValidation("play_count", func(fl validator.FieldLevel) bool {
+		return !cfg.Server.EnablePlayCount || fl.Field().Int() >= 1
+	})
+
+	kinds := map[string]export.Kind{"play_count": export.KindInt, "disable": export.KindBool, "id": export.KindInt}
+	for _, field := range cfg.Schema {
+		if field.Tag == "" || field.Tag == tag {
+			kinds[field.Name] = columnKind(cfg, field)
+		}
+	}
+
+	type recordRow struct {
+		record  sessionRecord
+		disable *bool
+	}
+	return runImport(ctx, db, cfg, format, r, importer[recordRow]{
+		kinds: kinds,
+		parse: func(m map[string]interface{}) (recordRow, error) {
+			if _, ok := m["data"]; !ok {
+				data := make(map[string]interface{})
+				for k, v := range m {
+					if !slices.Contains(importRecordMeta, k) {
+						data[k] = v
+					}
+				}
+				m["data"] = data
+			}
+			var row models.ImportRecordRow
+			if err := decodeRow(m, &row); err != nil {
+				return recordRow{}, err
+			}
+			if err := validate.Struct(row); err != nil {
+				return recordRow{}, err
+			}
+			renamedData, err := validateRecordData(cfg, tag, row.Data)
+			if err != nil {
+				return recordRow{}, err
+			}
+			createdAt, err := parseImportTime(row.CreatedAt)
+			if err != nil {
+				return recordRow{}, err
+			}
+			// 過去のデータなので、played_atの範囲はチェックしない
+			playedAt, err := parseImportTime(row.PlayedAt)
+			if err != nil {
+				return recordRow{}, fmt.Errorf("invalid played_at format (use RFC3339 or YYYY-MM-DD HH:MM:SS)")
+			}
+			return recordRow{
+				record: sessionRecord{
+					UUID:      row.UUID,
+					PlayCount: row.PlayCount,
+					Data:      renamedData,
+					IP:        row.IPAddress,
+					CreatedAt: createdAt,
+					PlayedAt:  playedAt,
+					Source:    sourceImport,
+				},
+				disable: row.Disable,
+			}, nil
+		},
+		apply: func(ctx context.Context, tx *sql.Tx, row recordRow) error {
+			sessionId, _, err := upsertRecord(ctx, tx, cfg, nil, row.record)
+			if err != nil {
+				return err
+			}
+			if row.disable != nil {
+				_, err = tx.ExecContext(ctx, "UPDATE sessions SET disable = ? WHERE id = ?", *row.disable, sessionId)
+			}
+			return err
+		},
+	})
+}
+
+// ImportLogs: 過去のログを一括で登録する
+// 各行は PostLogs と同じ検証を行い、セッションがなければ作成する
+func ImportLogs(ctx context.Context, db *sql.DB, cfg *config.Config, format string, r io.Reader) (*ImportReport, error) {
+	// play_countタグのバリデーション追加
+	validate.RegisterValidation("play_count", func(fl validator.FieldLevel) bool {
+		return !cfg.Server.EnablePlayCount || fl.Field().Int() >= 1
+	})
+
+	// play_countの有効無効の設定に応じた動的な変更
+	playCountAddText := [3]string{}
+	if cfg.Server.EnablePlayCount {
+		playCountAddText[0] = ", play_count"
+		playCountAddText[1] = ", ?"
+		playCountAddText[2] = " AND play_count = ?"
+	}
+	insertSession := fmt.Sprintf(`
+		INSERT OR IGNORE INTO sessions (uuid%s, data, ip_address)
+		VALUES (?%s, jsonb('{}'), ?)`, playCountAddText[0], playCountAddText[1])
+	selectSession := fmt.Sprintf("SELECT id FROM sessions WHERE uuid = ?%s", playCountAddText[2])
+
+	// 同じセッションのログが続くことが多いので、セッションIDを覚えておく
+	sessionIds := make(map[string]int64)
+
+	type logRow struct {
+		models.ImportLogRow
+		data interface{} // 検証したdataのJSON（なければnil）
+	}
+	return runImport(ctx, db, cfg, format, r, importer[logRow]{
+		kinds: map[string]export.Kind{"play_count": export.KindInt, "type": export.KindInt, "session_id": export.KindInt, "id": export.KindInt},
+		parse: func(m map[string]interface{}) (logRow, error) {
+			var row logRow
+			// CSVではdataはJSONの文字列として入っている（エクスポートと同じ形式）
+			if str, ok := m["data"].(string); ok {
+				if str == "" {
+					delete(m, "data")
+				} else {
+					var data map[string]interface{}
+					if err := json.Unmarshal([]byte(str), &data); err != nil {
+						return row, fmt.Errorf("data must be a JSON object")
+					}
+					m["data"] = data
+				}
+			}
+			if err := decodeRow(m, &row.ImportLogRow); err != nil {
+				return row, err
+			}
+			if err := validate.Struct(row.ImportLogRow); err != nil {
+				return row, err
+			}
+			if !logTypeDeclared(cfg, row.Type) {
+				return row, fmt.Errorf("undeclared log type %d", row.Type)
+			}
+			createdAt, err := parseImportTime(row.CreatedAt)
+			if err != nil {
+				return row, err
+			}
+			row.CreatedAt = createdAt
+			if row.Data != nil {
+				data, _, err := checkLogData(cfg, nil, row.Type, row.Data)
+				if err != nil {
+					return row, fmt.Errorf("data: %v", err)
+				}
+				row.data = data
+			}
+			return row, nil
+		},
+		apply: func(ctx context.Context, tx *sql.Tx, row logRow) error {
+			reqId := []interface{}{row.UUID}
+			key := row.UUID
+			if cfg.Server.EnablePlayCount {
+				reqId = append(reqId, row.PlayCount)
+				key += "/" + strconv.Itoa(*row.PlayCount)
+			}
+
+			sessionId, ok := sessionIds[key]
+			if !ok {
+				if _, err := tx.ExecContext(ctx, insertSession, append(reqId, row.IPAddress)...); err != nil {
+					return err
+				}
+				if err := tx.QueryRowContext(ctx, selectSession, reqId...).Scan(&sessionId); err != nil {
+					return err
+				}
+				sessionIds[key] = sessionId
+			}
+
+			var createdAt interface{}
+			if row.CreatedAt != "" {
+				createdAt = row.CreatedAt
+			}
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO logs (session_id, type, content, data, created_at)
+				VALUES (?, ?, ?, jsonb(?), COALESCE(?, datetime('now', 'localtime')))`,
+				sessionId, row.Type, row.Content, row.data, createdAt)
+			return err
+		},
+	})
+}
+
+// リクエストの形式（formatパラメーター、なければContent-Type）
+func requestImportFormat(c *fiber.Ctx) (string, error) {
+	format := c.Query("format")
+	if format == "" {
+		format = "ndjson"
+		if strings.Contains(string(c.Request().Header.ContentType()), "csv") {
+			format = "csv"
+		}
+	}
+	return importFormat(format)
+}
+
+// PostImportRecords: レコードの一括インポート（管理者用）
+func PostImportRecords(db *sql.DB, cfg *config.Config, broker *events.Broker) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		format, err := requestImportFormat(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		tag := c.Params("Tag")
+		if tag != "" {
+			if _, ok := tagCondition(cfg, tag, "data"); !ok {
+				return c.Status(404).JSON(fiber.Map{"error": "Unknown tag"})
+			}
+		}
+
+		report, err := ImportRecords(c.UserContext(), db, cfg, tag, format, bytes.NewReader(c.Body()))
+		if report != nil && report.Imported > 0 {
+			broker.Publish(events.TopicRecords, events.RecordEvent{Action: sourceImport})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Import failed", "report": report})
+		}
+		return c.JSON(report)
+	}
+}
+
+// PostImportLogs: ログの一括インポート（管理者用）
+func PostImportLogs(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		format, err := requestImportFormat(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		report, err := ImportLogs(c.UserContext(), db, cfg, format, bytes.NewReader(c.Body()))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Import failed", "report": report})
+		}
+		return c.JSON(report)
+	}
+}
@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+)
+
+// ログの構造化データ（LOG_SCHEMA）の絞り込みと集計（管理者用）
+// 項目名はLOG_SCHEMAに定義されたものだけを受け付けるため、SQLに埋め込んでも安全
+
+// 絞り込みの比較演算子（filter=項目:演算子:値）
+var logFilterOps = map[string]string{"eq": "=", "ne": "!=", "gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+
+// 集計関数（countは項目の指定なし、sum, avgは数値型の項目のみ）
+var logAggregates = map[string]string{"count": "COUNT", "sum": "SUM", "avg": "AVG", "min": "MIN", "max": "MAX"}
+
+// logDataColumn: dataの項目を取り出す式
+func logDataColumn(name string) string {
+	return fmt.Sprintf("(l.data ->> '$.%s')", name)
+}
+
+func findLogField(fields []config.SchemaConfig, name string) (config.SchemaConfig, bool) {
+	for _, field := range fields {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return config.SchemaConfig{}, false
+}
+
+// logDataConditions: type（必須）、uuid, since, until, filterの条件を組み立てる
+// dataのないログは対象にしない
+func logDataConditions(c *fiber.Ctx, cfg *config.Config) (int, []config.SchemaConfig, []string, []interface{}, error) {
+	// 項目は種類ごとに異なるため、1つの種類だけを指定してもらう（IDまたは名前）
+	logTypes, err := parseLogTypes(c, cfg)
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+	if len(logTypes) != 1 {
+		return 0, nil, nil, nil, fmt.Errorf("type is required (a single log type)")
+	}
+	logType := logTypes[0]
+	fields, ok := logFields(cfg, logType)
+	if !ok {
+		return 0, nil, nil, nil, fmt.Errorf("type %d has no LOG_SCHEMA", logType)
+	}
+
+	where := []string{"l.type = ?", "l.data IS NOT NULL"}
+	args := []interface{}{logType}
+	if uuid := c.Query("uuid"); uuid != "" {
+		where = append(where, "l.session_id IN (SELECT id FROM sessions WHERE uuid = ?)")
+		args = append(args, uuid)
+	}
+	where, args, err = timeRange(c, "l.created_at", where, args)
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+
+	// 値に:を含めてもよいように、先頭の2つだけで区切る
+	for _, raw := range c.Context().QueryArgs().PeekMulti("filter") {
+		parts := strings.SplitN(string(raw), ":", 3)
+		if len(parts) != 3 {
+			return 0, nil, nil, nil, fmt.Errorf("filter must be field:op:value")
+		}
+		field, ok := findLogField(fields, parts[0])
+		if !ok {
+			return 0, nil, nil, nil, fmt.Errorf("Unknown field: %s", parts[0])
+		}
+		op, ok := logFilterOps[parts[1]]
+		if !ok {
+			return 0, nil, nil, nil, fmt.Errorf("filter op must be one of eq, ne, gt, gte, lt, lte")
+		}
+		var value interface{} = parts[2]
+		if slices.Contains(cfg.TypeValidation.Numbers, field.Type) {
+			num, err := strconv.ParseFloat(parts[2], 64)
+			if err != nil {
+				return 0, nil, nil, nil, fmt.Errorf("%s must be a number", field.Name)
+			}
+			value = num
+		}
+		where = append(where, fmt.Sprintf("%s %s ?", logDataColumn(field.Name), op))
+		args = append(args, value)
+	}
+	return logType, fields, where, args, nil
+}
+
+// QueryLogs: 構造化データの項目で絞り込んだログを新しい順に返す（管理者用）
+// 例: ?type=2&filter=level:eq:3&filter=cause:eq:fall
+func QueryLogs(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logType, _, where, args, err := logDataConditions(c, cfg)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		escape, err := outputEscape(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		limit := c.QueryInt("limit", 100)
+		offset := c.QueryInt("offset", 0)
+		if limit <= 0 || offset < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "limit must be positive and offset must not be negative"})
+		}
+		// 最大値の制限（負荷対策）
+		if limit > cfg.Server.ReadLimit {
+			limit = cfg.Server.ReadLimit
+		}
+
+		// play_countは設定で有効な場合のみ列がある
+		selectColumns := []string{"l.id", "l.session_id", "s.uuid", "l.content", "json(l.data)", "l.created_at"}
+		if cfg.Server.EnablePlayCount {
+			selectColumns = append(selectColumns, "s.play_count")
+		}
+		query := fmt.Sprintf(`
+			SELECT %s
+			FROM logs l
+			JOIN sessions s ON s.id = l.session_id
+			WHERE %s
+			ORDER BY l.id DESC LIMIT ? OFFSET ?`, strings.Join(selectColumns, ", "), strings.Join(where, " AND "))
+		args = append(args, limit, offset)
+
+		rows, err := db.QueryContext(c.UserContext(), query, args...)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to query logs"})
+		}
+		defer rows.Close()
+
+		logs := []fiber.Map{}
+		for rows.Next() {
+			var id, sessionId int64
+			var uuid, content, data string
+			var playCount, createdAt interface{}
+			dest := []interface{}{&id, &sessionId, &uuid, &content, &data, &createdAt}
+			if cfg.Server.EnablePlayCount {
+				dest = append(dest, &playCount)
+			}
+			if err := rows.Scan(dest...); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to query logs"})
+			}
+			entry := fiber.Map{
+				"id":         id,
+				"session_id": sessionId,
+				"uuid":       uuid,
+				"type":       logType,
+				"content":    content,
+				"data":       json.RawMessage(data),
+				"created_at": createdAt,
+			}
+			if cfg.Server.EnablePlayCount {
+				entry["play_count"] = playCount
+			}
+			setLogTypeInfo(cfg, entry, logType)
+			logs = append(logs, entry)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to query logs"})
+		}
+		// Webページに直接埋め込む場合のHTMLエスケープ
+		if escape {
+			escapeHTMLValue(logs)
+		}
+
+		return c.JSON(fiber.Map{
+			"type": logType,
+			"logs": logs,
+		})
+	}
+}
+
+// AggregateLogs: 構造化データの項目ごとに集計する（管理者用）
+// group_byとmetricはカンマ区切りで複数指定できる。metricは count または 関数:項目（sum, avg, min, max）
+// 例: ステージごとの死亡数 ?type=2&group_by=level&metric=count
+// sortにmetricを指定するとその値の大きい順、省略するとgroup_byの項目の昇順に並べる
+func AggregateLogs(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logType, fields, where, args, err := logDataConditions(c, cfg)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		limit := c.QueryInt("limit", 100)
+		if limit <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "limit must be positive"})
+		}
+		if limit > cfg.Server.ReadLimit {
+			limit = cfg.Server.ReadLimit
+		}
+
+		// 集計の単位
+		groupBy := []string{}
+		var selects []string
+		if g := c.Query("group_by"); g != "" {
+			for _, name := range strings.Split(g, ",") {
+				field, ok := findLogField(fields, strings.TrimSpace(name))
+				if !ok {
+					return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Unknown field: %s", name)})
+				}
+				if slices.Contains(groupBy, field.Name) {
+					return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("%s is specified more than once in group_by", field.Name)})
+				}
+				groupBy = append(groupBy, field.Name)
+				selects = append(selects, logDataColumn(field.Name))
+			}
+		}
+
+		// 集計する値（結果のキーは count, sum_x のようにする）
+		var metrics []string
+		for _, m := range strings.Split(c.Query("metric", "count"), ",") {
+			fn, name, _ := strings.Cut(strings.TrimSpace(m), ":")
+			sqlFn, ok := logAggregates[fn]
+			if !ok {
+				return c.Status(400).JSON(fiber.Map{"error": "metric must be count or one of sum, avg, min, max with a field (e.g. avg:x)"})
+			}
+			key := fn
+			expr := "COUNT(*)"
+			if fn != "count" {
+				field, ok := findLogField(fields, name)
+				if !ok {
+					return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Unknown field: %s", name)})
+				}
+				if (fn == "sum" || fn == "avg") && !slices.Contains(cfg.TypeValidation.Numbers, field.Type) {
+					return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("%s of %s is not available (not a number)", fn, field.Name)})
+				}
+				key = fn + "_" + field.Name
+				expr = fmt.Sprintf("%s(%s)", sqlFn, logDataColumn(field.Name))
+			} else if name != "" {
+				return c.Status(400).JSON(fiber.Map{"error": "count does not take a field"})
+			}
+			if slices.Contains(metrics, key) {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("%s is specified more than once in metric", key)})
+			}
+			metrics = append(metrics, key)
+			selects = append(selects, expr)
+		}
+
+		// 集計の単位と並び順（列は1から数える）
+		groupCols := make([]string, len(groupBy))
+		for i := range groupBy {
+			groupCols[i] = strconv.Itoa(i + 1)
+		}
+		order := strings.Join(groupCols, ", ")
+		if sort := c.Query("sort"); sort != "" {
+			i := slices.Index(metrics, sort)
+			if i < 0 {
+				return c.Status(400).JSON(fiber.Map{"error": "sort must be one of the metrics"})
+			}
+			order = fmt.Sprintf("%d DESC", len(groupBy)+i+1)
+		}
+
+		query := fmt.Sprintf("SELECT %s FROM logs l WHERE %s", strings.Join(selects, ", "), strings.Join(where, " AND "))
+		if len(groupBy) > 0 {
+			query += " GROUP BY " + strings.Join(groupCols, ", ")
+		}
+		if order != "" {
+			query += " ORDER BY " + order
+		}
+		query += " LIMIT ?"
+		args = append(args, limit)
+
+		rows, err := db.QueryContext(c.UserContext(), query, args...)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to aggregate logs"})
+		}
+		defer rows.Close()
+
+		groups := []fiber.Map{}
+		for rows.Next() {
+			values := make([]interface{}, len(selects))
+			ptrs := make([]interface{}, len(selects))
+			for i := range values {
+				ptrs[i] = &values[i]
+			}
+			if err := rows.Scan(ptrs...); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to aggregate logs"})
+			}
+			for i, v := range values {
+				if b, ok := v.([]byte); ok {
+					values[i] = string(b)
+				}
+			}
+			key := fiber.Map{}
+			for i, name := range groupBy {
+				key[name] = values[i]
+			}
+			group := fiber.Map{"group": key}
+			for i, name := range metrics {
+				group[name] = values[len(groupBy)+i]
+			}
+			groups = append(groups, group)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to aggregate logs"})
+		}
+
+		return c.JSON(fiber.Map{
+			"type":     logType,
+			"group_by": groupBy,
+			"metrics":  metrics,
+			"groups":   groups,
+		})
+	}
+}
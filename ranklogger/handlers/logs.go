@@ -2,23 +2,31 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"html"
-	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 
 	"ranklogger/config"
 	"ranklogger/database"
+	"ranklogger/events"
+	"ranklogger/filter"
 	"ranklogger/middleware"
 	"ranklogger/models"
+	"ranklogger/tracing"
+	"ranklogger/webhook"
 )
 
 var varidate = validator.New()
 
-func PostLogs(db *sql.DB, cfg *config.Config) fiber.Handler {
+func PostLogs(db *sql.DB, cfg *config.Config, contentFilter *filter.Filter, broker *events.Broker, hooks *webhook.Dispatcher) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		var req models.PostLogsRequest
 		if err := c.BodyParser(&req); err != nil {
@@ -30,18 +38,50 @@ func PostLogs(db *sql.DB, cfg *config.Config) fiber.Handler {
 			return !cfg.Server.EnablePlayCount || fl.Field().Int() >= 1
 		})
 
+		ctx := c.UserContext()
+
 		// バリデーション
-		if err := validate.Struct(req); err != nil {
+		_, span := tracing.Start(ctx, "validate logs")
+		err := validate.Struct(req)
+		span.End()
+		if err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		// HTMLエスケープの適用
+		// LOG_TYPESにない種類は受け付けない
+		for i, l := range req.Logs {
+			if !logTypeDeclared(cfg, l.Type) {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("logs[%d].type: undeclared log type %d", i, l.Type)})
+			}
+		}
+
+		// 不適切な表現のチェック（HTMLエスケープはせず、そのまま保存する）
+		disable := false
 		for i := range req.Logs {
-			req.Logs[i].Content = html.EscapeString(req.Logs[i].Content)
+			content, flagged, err := filterText(contentFilter, cfg.ContentFilter.LogPolicy, fmt.Sprintf("logs[%d].content", i), req.Logs[i].Content)
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+			}
+			disable = disable || flagged
+			req.Logs[i].Content = content
+		}
+
+		// 構造化データの検証（LOG_SCHEMAに従う）
+		logData := make([]interface{}, len(req.Logs)) // jsonb(NULL)はNULLになる
+		for i, l := range req.Logs {
+			if l.Data == nil {
+				continue
+			}
+			data, flagged, err := checkLogData(cfg, contentFilter, l.Type, l.Data)
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("logs[%d].data: %v", i, err)})
+			}
+			disable = disable || flagged
+			logData[i] = data
 		}
 
 		// トランザクション開始
-		tx, err := db.Begin()
+		tx, err := db.BeginTx(ctx, nil)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Transaction failed"})
 		}
@@ -62,46 +102,86 @@ func PostLogs(db *sql.DB, cfg *config.Config) fiber.Handler {
 		query := fmt.Sprintf(`
 			INSERT OR IGNORE INTO sessions (uuid%s, data, ip_address) 
 			VALUES (?%s, jsonb('{}'), ?)`, playCountAddText[0], playCountAddText[1])
-		_, err = tx.Exec(query, append(reqId, middleware.GetTrustedIP(c, cfg))...)
+		_, err = tx.ExecContext(ctx, query, append(reqId, middleware.GetTrustedIP(c, cfg))...)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Session creation failed"})
 		}
 
 		var sessionId int
 		query = fmt.Sprintf("SELECT id FROM sessions WHERE uuid = ?%s", playCountAddText[2])
-		err = tx.QueryRow(query, reqId...).Scan(&sessionId)
+		err = tx.QueryRowContext(ctx, query, reqId...).Scan(&sessionId)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Session lookup failed"})
 		}
 
+		// 不適切な表現が含まれていた場合はセッションをランキングから除外する
+		if disable {
+			if _, err := tx.ExecContext(ctx, "UPDATE sessions SET disable = TRUE WHERE id = ?", sessionId); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Session update failed"})
+			}
+		}
+
 		// 2. ログのバルクインサート
 		// SQLiteの効率的なバルクインサート用にクエリを組み立てる
+		// 登録したログはライブ表示（GET /stream/logs）に流すため、IDと日時を返してもらう
+		entries := make([]events.LogEntry, 0, len(req.Logs))
 		if len(req.Logs) > 0 {
-			query := "INSERT INTO logs (session_id, type, content) VALUES "
+			query := "INSERT INTO logs (session_id, type, content, data) VALUES "
 			vals := []interface{}{}
-			for _, l := range req.Logs {
-				query += "(?, ?, ?),"
-				vals = append(vals, sessionId, l.Type, l.Content)
+			for i, l := range req.Logs {
+				query += "(?, ?, ?, jsonb(?)),"
+				vals = append(vals, sessionId, l.Type, l.Content, logData[i])
 			}
-			query = query[0 : len(query)-1] // 最後のカンマを削除
+			query = query[0:len(query)-1] + " RETURNING id, type, content, json(data), created_at" // 最後のカンマを削除
 
-			stmt, err := tx.Prepare(query)
+			stmt, err := tx.PrepareContext(ctx, query)
 			if err != nil {
 				return c.Status(500).JSON(fiber.Map{"error": "Prepare statement failed"})
 			}
-			if _, err := stmt.Exec(vals...); err != nil {
+			rows, err := stmt.QueryContext(ctx, vals...)
+			if err != nil {
 				return c.Status(500).JSON(fiber.Map{"error": "Log insert failed"})
 			}
+			for rows.Next() {
+				var e events.LogEntry
+				var data sql.NullString
+				if err := rows.Scan(&e.ID, &e.Type, &e.Content, &data, &e.CreatedAt); err != nil {
+					rows.Close()
+					return c.Status(500).JSON(fiber.Map{"error": "Log insert failed"})
+				}
+				if data.Valid {
+					e.Data = json.RawMessage(data.String)
+				}
+				entries = append(entries, e)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Log insert failed"})
+			}
+		}
+
+		logEvent := events.LogEvent{
+			SessionID: int64(sessionId),
+			UUID:      req.UUID,
+			PlayCount: req.PlayCount,
+			Logs:      entries,
+		}
+
+		// Webhook（無効化、エラーの種類のログ）
+		if disable {
+			if err := enqueueDisabled(ctx, tx, hooks, logEvent.SessionID, req.UUID, req.PlayCount, disabledByFilter); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Webhook enqueue failed"})
+			}
+		}
+		if err := enqueueErrorLogs(ctx, tx, cfg, hooks, logEvent); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Webhook enqueue failed"})
 		}
 
 		if err := tx.Commit(); err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
 		}
 
-		// 低確率で古いログのクリーンアップの実行（例：1/100の確率）
-		if rand.Intn(100) == 0 {
-			database.CleanupOldLogs(db, cfg.Retention.LogRetentionDays)
-		}
+		broker.Publish(events.TopicLogs, logEvent)
 
 		return c.Status(201).JSON(fiber.Map{
 			"message":    "Logs registered successfully",
@@ -110,22 +190,153 @@ func PostLogs(db *sql.DB, cfg *config.Config) fiber.Handler {
 	}
 }
 
-func GetLogs(db *sql.DB) fiber.Handler {
+// findLogType: typeのIDに対応するLOG_TYPESの設定
+func findLogType(cfg *config.Config, id int) (config.LogTypeConfig, bool) {
+	for _, t := range cfg.LogTypes {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return config.LogTypeConfig{}, false
+}
+
+// logTypeDeclared: 登録できるtypeか（LOG_TYPESを設定していなければすべて）
+func logTypeDeclared(cfg *config.Config, id int) bool {
+	if len(cfg.LogTypes) == 0 {
+		return true
+	}
+	_, ok := findLogType(cfg, id)
+	return ok
+}
+
+// setLogTypeInfo: レスポンスに種類の名前と重要度を付ける（LOG_TYPESにない種類はnull）
+func setLogTypeInfo(cfg *config.Config, entry fiber.Map, id int) {
+	entry["type_name"] = nil
+	entry["severity"] = nil
+	if t, ok := findLogType(cfg, id); ok {
+		entry["type_name"] = t.Name
+		entry["severity"] = t.Severity
+	}
+}
+
+// parseLogTypes: ?type= の値をtypeのIDのリストにする（指定なしはnil）
+// IDの代わりにLOG_TYPESの名前を使え、カンマ区切りや複数指定（?type=error&type=crash）で複数の種類を指定できる
+// IDはLOG_TYPESを設定する前に登録されたログも探せるように、LOG_TYPESにないものも受け付ける
+func parseLogTypes(c *fiber.Ctx, cfg *config.Config) ([]int, error) {
+	var types []int
+	for _, raw := range c.Context().QueryArgs().PeekMulti("type") {
+		for _, v := range strings.Split(string(raw), ",") {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				id = 0
+				for _, t := range cfg.LogTypes {
+					if t.Name == v {
+						id = t.ID
+						break
+					}
+				}
+			}
+			if id < 1 {
+				return nil, fmt.Errorf("Unknown log type: %s", v)
+			}
+			if !slices.Contains(types, id) {
+				types = append(types, id)
+			}
+		}
+	}
+	return types, nil
+}
+
+// logTypeCondition: typeのIDのリストで絞り込む条件
+func logTypeCondition(column string, types []int) (string, []interface{}) {
+	args := make([]interface{}, len(types))
+	for i, t := range types {
+		args[i] = t
+	}
+	return fmt.Sprintf("%s IN (%s)", column, strings.TrimSuffix(strings.Repeat("?, ", len(types)), ", ")), args
+}
+
+// logFields: そのログの種類の構造化データの項目（LOG_SCHEMAになければfalse）
+func logFields(cfg *config.Config, logType int) ([]config.SchemaConfig, bool) {
+	for _, schema := range cfg.LogSchema {
+		if schema.Type == logType {
+			return schema.Fields, true
+		}
+	}
+	return nil, false
+}
+
+// checkLogData: LOG_SCHEMAに従ってログのdataを検査し、保存するJSONを返す
+// contentFilterがnilの場合（インポート）は不適切な表現のチェックをしない。FILTERがdisableの項目に該当した場合はtrueを返す
+func checkLogData(cfg *config.Config, contentFilter *filter.Filter, logType int, data map[string]interface{}) (string, bool, error) {
+	fields, ok := logFields(cfg, logType)
+	if !ok {
+		return "", false, fmt.Errorf("type %d has no LOG_SCHEMA", logType)
+	}
+	disable := false
+	if contentFilter != nil {
+		flagged, err := filterLogData(contentFilter, fields, data)
+		if err != nil {
+			return "", false, err
+		}
+		disable = flagged
+	}
+	validData, err := validateLogData(cfg, fields, data)
+	if err != nil {
+		return "", false, err
+	}
+	b, err := json.Marshal(validData)
+	if err != nil {
+		return "", false, err
+	}
+	return string(b), disable, nil
+}
+
+// validateLogData: RECORD_SCHEMAと同じく、定義した項目はすべて必須で、定義のない項目は保存しない
+func validateLogData(cfg *config.Config, fields []config.SchemaConfig, data map[string]interface{}) (map[string]interface{}, error) {
+	validData := make(map[string]interface{})
+	for _, field := range fields {
+		val, exists := data[field.Name]
+		if !exists {
+			return nil, fmt.Errorf("Missing required field: %s", field.Name)
+		}
+		val, err := checkFieldValue(cfg, field, val)
+		if err != nil {
+			return nil, err
+		}
+		validData[field.Name] = val
+	}
+	return validData, nil
+}
+
+func GetLogs(db *sql.DB, cfg *config.Config) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		sessionId := c.Params("SessionId")
 
 		// ページネーション設定
 		limit := c.QueryInt("limit", 100) // ログは一度に多く見たいのでデフォルト100
 		offset := c.QueryInt("offset", 0)
-		logType := c.QueryInt("type", 0) // 0は指定なし
+		logTypes, err := parseLogTypes(c, cfg) // nilは指定なし
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		escape, err := outputEscape(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
 
 		// クエリの組み立て
-		query := "SELECT id, type, content FROM logs WHERE session_id = ?"
+		query := "SELECT id, type, content, json(data) FROM logs WHERE session_id = ?"
 		args := []interface{}{sessionId}
 
-		if logType != 0 {
-			query += " AND type = ?"
-			args = append(args, logType)
+		if len(logTypes) > 0 {
+			cond, typeArgs := logTypeCondition("type", logTypes)
+			query += " AND " + cond
+			args = append(args, typeArgs...)
 		}
 
 		sinceStr := c.Query("since")
@@ -142,7 +353,7 @@ func GetLogs(db *sql.DB) fiber.Handler {
 		query += fmt.Sprintf(" ORDER BY id ASC LIMIT %d OFFSET %d", limit, offset)
 
 		// 実行
-		rows, err := db.Query(query, args...)
+		rows, err := db.QueryContext(c.UserContext(), query, args...)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch logs"})
 		}
@@ -152,14 +363,24 @@ func GetLogs(db *sql.DB) fiber.Handler {
 		for rows.Next() {
 			var id, lType int
 			var content string
-			if err := rows.Scan(&id, &lType, &content); err != nil {
+			var data sql.NullString
+			if err := rows.Scan(&id, &lType, &content, &data); err != nil {
 				continue
 			}
-			logs = append(logs, fiber.Map{
+			entry := fiber.Map{
 				"id":      id,
 				"type":    lType,
-				"content": content, // すでに保存時にエスケープ済み
-			})
+				"content": content, // 送られたまま保存されている
+			}
+			setLogTypeInfo(cfg, entry, lType)
+			if data.Valid {
+				entry["data"] = json.RawMessage(data.String)
+			}
+			logs = append(logs, entry)
+		}
+		// Webページに直接埋め込む場合のHTMLエスケープ
+		if escape {
+			escapeHTMLValue(logs)
 		}
 
 		return c.JSON(fiber.Map{
@@ -168,3 +389,153 @@ func GetLogs(db *sql.DB) fiber.Handler {
 		})
 	}
 }
+
+// 検索結果の一致箇所の目印（HTMLエスケープの後に<mark>に置き換えるため、本文に出てこない文字を使う）
+const (
+	snippetStart = "\ue000"
+	snippetEnd   = "\ue001"
+)
+
+// searchTerms: 検索語をFTS5のクエリに変換する（スペース区切りの語をすべて含むもの）
+// 語はそれぞれフレーズとして扱うため、記号を含んでいてもFTS5の構文エラーにならない
+func searchTerms(q string) (string, error) {
+	fields := strings.Fields(q)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("q is required")
+	}
+	terms := make([]string, len(fields))
+	for i, f := range fields {
+		// trigramの索引では3文字未満の語は検索できない
+		if utf8.RuneCountInString(f) < 3 {
+			return "", fmt.Errorf("each search term must be at least 3 characters")
+		}
+		terms[i] = `"` + strings.ReplaceAll(f, `"`, `""`) + `"`
+	}
+	return strings.Join(terms, " AND "), nil
+}
+
+// SearchLogs: すべてのセッションのログをcontentの全文検索で探す（管理者用）
+// type, uuid, タグ（そのタグのレコードを持つセッション）, since, untilで絞り込み、一致箇所を<mark>で囲んだ抜粋を返す
+func SearchLogs(db *sql.DB, cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		if !database.LogSearchAvailable(ctx, db) {
+			return c.Status(501).JSON(fiber.Map{"error": "Full-text search is not available"})
+		}
+
+		match, err := searchTerms(c.Query("q"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		// snippetは常にエスケープ済みのHTMLを返すため、escapeは値の確認だけ行う
+		if _, err := outputEscape(c); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		limit := c.QueryInt("limit", 50)
+		offset := c.QueryInt("offset", 0)
+		if limit <= 0 || offset < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "limit must be positive and offset must not be negative"})
+		}
+		// 最大値の制限（負荷対策）
+		if limit > cfg.Server.ReadLimit {
+			limit = cfg.Server.ReadLimit
+		}
+
+		where := []string{"logs_fts MATCH ?"}
+		args := []interface{}{match}
+		logTypes, err := parseLogTypes(c, cfg)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if len(logTypes) > 0 {
+			cond, typeArgs := logTypeCondition("l.type", logTypes)
+			where = append(where, cond)
+			args = append(args, typeArgs...)
+		}
+		if uuid := c.Query("uuid"); uuid != "" {
+			where = append(where, "s.uuid = ?")
+			args = append(args, uuid)
+		}
+		if tag := c.Query("tag"); tag != "" {
+			cond, ok := tagCondition(cfg, tag, "s.data")
+			if !ok {
+				return c.Status(404).JSON(fiber.Map{"error": "Unknown tag"})
+			}
+			where = append(where, cond)
+		}
+		where, args, err = timeRange(c, "l.created_at", where, args)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		// relevance: 一致度の高い順（bm25）、newest: 新しい順
+		order := "rank"
+		switch c.Query("sort", "relevance") {
+		case "relevance":
+		case "newest":
+			order = "l.id DESC"
+		default:
+			return c.Status(400).JSON(fiber.Map{"error": "sort must be relevance or newest"})
+		}
+
+		// play_countは設定で有効な場合のみ列がある
+		selectColumns := []string{"l.id", "l.session_id", "s.uuid", "l.type", "l.created_at", "snippet(logs_fts, 0, ?, ?, '…', 64)"}
+		if cfg.Server.EnablePlayCount {
+			selectColumns = append(selectColumns, "s.play_count")
+		}
+		query := fmt.Sprintf(`
+			SELECT %s
+			FROM logs_fts
+			JOIN logs l ON l.id = logs_fts.rowid
+			JOIN sessions s ON s.id = l.session_id
+			WHERE %s
+			ORDER BY %s LIMIT ? OFFSET ?`, strings.Join(selectColumns, ", "), strings.Join(where, " AND "), order)
+		args = append([]interface{}{snippetStart, snippetEnd}, args...)
+		args = append(args, limit, offset)
+
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to search logs"})
+		}
+		defer rows.Close()
+
+		results := []fiber.Map{}
+		for rows.Next() {
+			var id, sessionId int64
+			var lType int
+			var uuid, snippet string
+			var playCount, createdAt interface{}
+			dest := []interface{}{&id, &sessionId, &uuid, &lType, &createdAt, &snippet}
+			if cfg.Server.EnablePlayCount {
+				dest = append(dest, &playCount)
+			}
+			if err := rows.Scan(dest...); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to search logs"})
+			}
+			// 目印を<mark>にするためsnippetはHTMLとして扱われる。本文は常にエスケープし、<mark>だけをタグとして残す
+			snippet = html.EscapeString(snippet)
+			snippet = strings.NewReplacer(snippetStart, "<mark>", snippetEnd, "</mark>").Replace(snippet)
+			result := fiber.Map{
+				"id":         id,
+				"session_id": sessionId,
+				"uuid":       uuid,
+				"type":       lType,
+				"created_at": createdAt,
+				"snippet":    snippet,
+			}
+			if cfg.Server.EnablePlayCount {
+				result["play_count"] = playCount
+			}
+			setLogTypeInfo(cfg, result, lType)
+			results = append(results, result)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to search logs"})
+		}
+
+		return c.JSON(fiber.Map{
+			"query": c.Query("q"),
+			"logs":  results,
+		})
+	}
+}
@@ -3,29 +3,40 @@ package handlers
 import (
 	"database/sql"
 	"fmt"
+	"ranklogger/database"
 	"ranklogger/middleware"
 	"runtime"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-func GetMetrics(db *sql.DB, stats *middleware.LatencyStats) fiber.Handler {
+func GetMetrics(db *sql.DB, stats *middleware.LatencyStats, maintenance *database.Maintenance) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+
 		// 1. レコード総数の取得
 		var totalSessions, totalLogs int
-		_ = db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&totalSessions)
-		_ = db.QueryRow("SELECT COUNT(*) FROM logs").Scan(&totalLogs)
+		_ = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sessions").Scan(&totalSessions)
+		_ = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM logs").Scan(&totalLogs)
 
 		// 2. DBファイルサイズの取得 (SQLite特有)
 		// ページ数 * ページサイズ で計算
 		var pageSize, pageCount int64
-		_ = db.QueryRow("PRAGMA page_size").Scan(&pageSize)
-		_ = db.QueryRow("PRAGMA page_count").Scan(&pageCount)
+		_ = db.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize)
+		_ = db.QueryRowContext(ctx, "PRAGMA page_count").Scan(&pageCount)
 		dbSizeMB := float64(pageSize*pageCount) / 1024 / 1024
 
 		// 3. (オプション) 本日の活動状況
 		var logsToday int
-		_ = db.QueryRow("SELECT COUNT(*) FROM logs WHERE created_at > date('now', 'localtime')").Scan(&logsToday)
+		_ = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM logs WHERE created_at > date('now', 'localtime')").Scan(&logsToday)
+
+		// 4. レイテンシの集計期間 (1m, 5m, 1h)
+		window := c.Query("window", "5m")
+		minutes, ok := middleware.LatencyWindows[window]
+		if !ok {
+			return c.Status(400).JSON(fiber.Map{"error": "window must be one of 1m, 5m, 1h"})
+		}
+		overall, endpoints := stats.Summary(minutes)
 
 		return c.JSON(fiber.Map{
 			"database": fiber.Map{
@@ -37,13 +48,20 @@ func GetMetrics(db *sql.DB, stats *middleware.LatencyStats) fiber.Handler {
 			"system": fiber.Map{
 				"goroutines": runtime.NumGoroutine(),
 				"latency_ms": fiber.Map{
-					"p50":     fmt.Sprintf("%.2f", stats.GetPercentile(50)),
-					"p95":     fmt.Sprintf("%.2f", stats.GetPercentile(95)),
-					"p99":     fmt.Sprintf("%.2f", stats.GetPercentile(99)),
-					"samples": stats.SampleCount(), // 現在の蓄積数
+					"window":            window,
+					"p50":               fmt.Sprintf("%.2f", overall.P50),
+					"p95":               fmt.Sprintf("%.2f", overall.P95),
+					"p99":               fmt.Sprintf("%.2f", overall.P99),
+					"samples":           overall.Samples, // 集計期間内のリクエスト数
+					"client_error_rate": overall.ClientErrorRate,
+					"server_error_rate": overall.ServerErrorRate,
 				},
+				// エンドポイント（メソッド＋ルート定義）ごとの集計
+				"endpoints": endpoints,
 				// 他の動的な指標があればここに追加
 			},
+			// バックグラウンドのメンテナンス処理の直近の結果
+			"maintenance": maintenance.Results(),
 		})
 	}
 }
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+	"ranklogger/events"
+	"ranklogger/filter"
+	"ranklogger/models"
+)
+
+// プレイヤープロフィールをJSON（オブジェクト）として取り出す式
+// /records の各行に付与するときにも使う（プロフィールがなければNULL）
+const playerObjectColumns = `json_object(
+	'display_name', players.display_name,
+	'country', players.country,
+	'avatar_url', players.avatar_url,
+	'data', json(players.data))`
+
+// validatePlayerData: PLAYER_SCHEMAに従って独自項目を確認する
+// 定義されていない項目は保存しない（レコードのdataと同じ）
+func validatePlayerData(cfg *config.Config, contentFilter *filter.Filter, data map[string]interface{}) (map[string]interface{}, error) {
+	validData := make(map[string]interface{})
+	for _, field := range cfg.PlayerSchema {
+		val, exists := data[field.Name]
+		if !exists || val == nil {
+			continue
+		}
+		// 不適切な表現のチェック
+		if str, ok := val.(string); ok {
+			filtered, _, err := filterText(contentFilter, field.Filter, field.Name, str)
+			if err != nil {
+				return nil, err
+			}
+			val = filtered
+		}
+		val, err := checkFieldValue(cfg, field, val)
+		if err != nil {
+			return nil, err
+		}
+		validData[field.Name] = val
+	}
+	return validData, nil
+}
+
+// PutPlayer: プレイヤープロフィールの作成・更新（送られた内容で置き換える）
+func PutPlayer(db *sql.DB, cfg *config.Config, contentFilter *filter.Filter, broker *events.Broker) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		uuid := c.Params("UUID")
+		if err := validate.Var(uuid, "uuid4"); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid UUID"})
+		}
+
+		var input models.PutPlayerRequest
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON"})
+		}
+		if err := validate.Struct(input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		// 不適切な表現のチェック（プレイヤーの表示名はCONTENT_FILTER:DISPLAY_NAME_POLICYに従う）
+		displayName, _, err := filterText(contentFilter, cfg.ContentFilter.DisplayNamePolicy, "display_name", input.DisplayName)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		data, err := validatePlayerData(cfg, contentFilter, input.Data)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to save player"})
+		}
+
+		var country, avatarURL interface{}
+		if input.Country != "" {
+			country = input.Country
+		}
+		if input.AvatarURL != "" {
+			avatarURL = input.AvatarURL
+		}
+
+		var player string
+		err = db.QueryRowContext(c.UserContext(), fmt.Sprintf(`
+			INSERT INTO players (uuid, display_name, country, avatar_url, data)
+			VALUES (?, ?, ?, ?, jsonb(?))
+			ON CONFLICT(uuid) DO UPDATE SET
+				display_name = excluded.display_name,
+				country = excluded.country,
+				avatar_url = excluded.avatar_url,
+				data = excluded.data,
+				updated_at = datetime('now', 'localtime')
+			RETURNING %s`, playerObjectColumns),
+			uuid, displayName, country, avatarURL, string(jsonData)).Scan(&player)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to save player"})
+		}
+		// ランキングに表示される名前などが変わる
+		broker.Publish(events.TopicRecords, events.RecordEvent{Action: "player", UUID: uuid})
+
+		return c.JSON(fiber.Map{
+			"message": "Player saved successfully",
+			"uuid":    uuid,
+			"player":  json.RawMessage(player),
+		})
+	}
+}
+
+// GetPlayer: プレイヤープロフィールの取得
+func GetPlayer(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		uuid := c.Params("UUID")
+		if err := validate.Var(uuid, "uuid4"); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid UUID"})
+		}
+		escape, err := outputEscape(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		var player string
+		err = db.QueryRowContext(c.UserContext(),
+			fmt.Sprintf("SELECT %s FROM players WHERE uuid = ?", playerObjectColumns), uuid).Scan(&player)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Player not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch player"})
+		}
+
+		var profile interface{} = json.RawMessage(player)
+		// Webページに直接埋め込む場合のHTMLエスケープ
+		if escape {
+			profile = escapeHTMLValue(profile)
+		}
+		return c.JSON(fiber.Map{
+			"uuid":   uuid,
+			"player": profile,
+		})
+	}
+}
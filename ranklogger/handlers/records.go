@@ -1,10 +1,10 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"html"
 	"slices"
 	"strconv"
 	"strings"
@@ -14,14 +14,18 @@ import (
 	"github.com/gofiber/fiber/v2"
 
 	"ranklogger/config"
+	"ranklogger/events"
+	"ranklogger/filter"
 	"ranklogger/middleware"
 	"ranklogger/models"
+	"ranklogger/tracing"
+	"ranklogger/webhook"
 )
 
 var validate = validator.New()
 
 // PostRecord はスコアを保存するハンドラー
-func PostRecord(db *sql.DB, cfg *config.Config) fiber.Handler {
+func PostRecord(db *sql.DB, cfg *config.Config, contentFilter *filter.Filter, broker *events.Broker, hooks *webhook.Dispatcher) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		// JSONの解析
 		var input models.GameRecordRequest
@@ -34,104 +38,470 @@ func PostRecord(db *sql.DB, cfg *config.Config) fiber.Handler {
 			return !cfg.Server.EnablePlayCount || fl.Field().Int() >= 1
 		})
 
+		ctx := c.UserContext()
+		tag := c.Params("Tag")
+
+		// バリデーション（トレース上で処理時間を分けて見られるようにスパンを切る）
+		_, span := tracing.Start(ctx, "validate record")
 		// modelsのstructで設定したタグに応じたバリデーションを実施
+		err := validate.Struct(input)
+		var disable bool
+		if err == nil {
+			// 不適切な表現のチェック
+			disable, err = filterRecordData(cfg, contentFilter, tag, input.Data)
+		}
+		var renamedData map[string]interface{}
+		if err == nil {
+			// 動的スキーマチェック (config.yamlとの照合)
+			renamedData, err = validateRecordData(cfg, tag, input.Data)
+		}
+		var playedAt string
+		if err == nil {
+			playedAt, err = parsePlayedAt(cfg, input.PlayedAt)
+		}
+		span.End()
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		// 登録前の値と比べるため、読み取りと登録を1つのトランザクションで行う
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Transaction failed"})
+		}
+		defer tx.Rollback()
+
+		sessionId, improved, err := upsertRecord(ctx, tx, cfg, hooks, sessionRecord{
+			UUID:      input.UUID,
+			PlayCount: input.PlayCount,
+			Data:      renamedData,
+			IP:        middleware.GetTrustedIP(c, cfg),
+			PlayedAt:  playedAt,
+			Source:    sourcePost,
+			IdemKey:   middleware.IdempotencyKey(c),
+			Disable:   disable,
+		})
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Record insert failed"})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		broker.Publish(events.TopicRecords, events.RecordEvent{Action: sourcePost, SessionID: sessionId})
+
+		return c.Status(201).JSON(fiber.Map{
+			"message":    "Record registered successfully",
+			"session_id": sessionId,
+			"improved":   improved,
+		})
+	}
+}
+
+// PostRecordsBatch: オフラインでプレイした複数のレコードをまとめて登録する
+// 各レコードはPostRecordと同じ検証を行い、問題のないものを1つのトランザクションで登録してレコードごとの結果を返す
+func PostRecordsBatch(db *sql.DB, cfg *config.Config, contentFilter *filter.Filter, broker *events.Broker, hooks *webhook.Dispatcher) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var input models.PostRecordsBatchRequest
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON"})
+		}
 		if err := validate.Struct(input); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 		}
+		if len(input.Records) > cfg.Submission.MaxBatchSize {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("records must be <= %d", cfg.Submission.MaxBatchSize)})
+		}
 
-		tag := c.Params("Tag")
-		// 動的スキーマチェック (config.yamlとの照合)
-		renamedData := make(map[string]interface{})
-		for _, field := range cfg.Schema {
-			// タグが設定されていてかつ異なったら無視
-			if field.Tag != "" && field.Tag != tag {
+		// play_countタグのバリデーション追加
+		validate.RegisterValidation("play_count", func(fl validator.FieldLevel) bool {
+			return !cfg.Server.EnablePlayCount || fl.Field().Int() >= 1
+		})
+
+		ctx := c.UserContext()
+		ip := middleware.GetTrustedIP(c, cfg)
+		idemKey := middleware.IdempotencyKey(c)
+
+		// バリデーション
+		_, span := tracing.Start(ctx, "validate records")
+		results := make([]fiber.Map, len(input.Records))
+		records := make([]*sessionRecord, len(input.Records))
+		for i, item := range input.Records {
+			err := validate.Struct(item)
+			var disable bool
+			if err == nil {
+				disable, err = filterRecordData(cfg, contentFilter, item.Tag, item.Data)
+			}
+			var renamedData map[string]interface{}
+			if err == nil {
+				renamedData, err = validateRecordData(cfg, item.Tag, item.Data)
+			}
+			var playedAt string
+			if err == nil {
+				playedAt, err = parsePlayedAt(cfg, item.PlayedAt)
+			}
+			if err != nil {
+				results[i] = fiber.Map{"index": i, "status": 400, "error": err.Error()}
 				continue
 			}
+			records[i] = &sessionRecord{
+				UUID:      item.UUID,
+				PlayCount: item.PlayCount,
+				Data:      renamedData,
+				IP:        ip,
+				PlayedAt:  playedAt,
+				Source:    sourceBatch,
+				IdemKey:   idemKey,
+				Disable:   disable,
+			}
+		}
+		span.End()
 
-			val, exists := input.Data[field.Name]
-			if !exists {
-				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Missing required field: %s", field.Name)})
+		// 問題のなかったレコードを1つのトランザクションで登録
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Transaction failed"})
+		}
+		defer tx.Rollback()
+
+		for i, rec := range records {
+			if rec == nil {
+				continue
+			}
+			sessionId, improved, err := upsertRecord(ctx, tx, cfg, hooks, *rec)
+			if err != nil {
+				results[i] = fiber.Map{"index": i, "status": 500, "error": "Record insert failed"}
+				continue
 			}
+			results[i] = fiber.Map{"index": i, "status": 201, "session_id": sessionId, "improved": improved}
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
 
-			// 型の簡易チェック (例: INTEGERならfloat64としてパースされるので数値チェック)
-			switch true {
-			case slices.Contains(cfg.TypeValidation.Numbers, field.Type):
-				num, ok := val.(float64) // JSONの数値はGoではfloat64としてパースされる
-				if !ok {
-					return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("%s must be a number", field.Name)})
-				}
+		succeeded := 0
+		for _, r := range results {
+			if r["status"] == 201 {
+				succeeded++
+				broker.Publish(events.TopicRecords, events.RecordEvent{Action: sourceBatch, SessionID: r["session_id"].(int64)})
+			}
+		}
+		// 1件でも失敗があれば207 (Multi-Status)
+		status := 201
+		if succeeded < len(results) {
+			status = 207
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"message":   "Records processed",
+			"succeeded": succeeded,
+			"failed":    len(results) - succeeded,
+			"results":   results,
+		})
+	}
+}
 
-				// min / max チェック
-				if field.Min != nil && int(num) < *field.Min {
-					return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("%s must be >= %d", field.Name, *field.Min)})
-				}
-				if field.Max != nil && int(num) > *field.Max {
-					return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("%s must be <= %d", field.Name, *field.Max)})
-				}
+// parsePlayedAt: クライアントから送られたプレイ日時（RFC3339）を検証し、DBと同じ形式（ローカル時刻）に変換する
+// 未来すぎる日時と、SUBMISSION:PLAYED_AT_MAX_PAST_DAYSより古い日時は受け付けない
+func parsePlayedAt(cfg *config.Config, s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return "", fmt.Errorf("invalid played_at format (use RFC3339)")
+	}
+	now := time.Now()
+	if t.After(now.Add(time.Duration(cfg.Submission.PlayedAtMaxFutureSeconds) * time.Second)) {
+		return "", fmt.Errorf("played_at must not be in the future")
+	}
+	if t.Before(now.AddDate(0, 0, -cfg.Submission.PlayedAtMaxPastDays)) {
+		return "", fmt.Errorf("played_at must be within %d days", cfg.Submission.PlayedAtMaxPastDays)
+	}
+	return t.In(time.Local).Format(time.DateTime), nil
+}
 
-			case slices.Contains(cfg.TypeValidation.Strings, field.Type):
-				str, ok := val.(string)
-				if !ok {
-					return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("%s must be a string", field.Name)})
-				}
+// DBとトランザクションのどちらでも実行できるようにする
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
 
-				// min / max チェック
-				if field.Min != nil && len([]rune(str)) < *field.Min {
-					return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("length of %s must be >= %d", field.Name, *field.Min)})
-				}
-				if field.Max != nil && len([]rune(str)) > *field.Max {
-					return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("length of %s must be <= %d", field.Name, *field.Max)})
-				}
+// 登録するセッション（dataはDB上の名前に変換済みのもの）
+type sessionRecord struct {
+	UUID      string
+	PlayCount *int
+	Data      map[string]interface{}
+	IP        string
+	CreatedAt string // 空の場合は現在日時
+	PlayedAt  string // 空の場合はNULL
+	Source    string // 送信履歴に記録する登録元
+	IdemKey   string // 送信履歴に記録するIdempotency-Key
+	Disable   bool   // trueの場合は登録後にランキングから除外する（コンテンツフィルター）
+}
 
-				// --- XSS対策: HTMLエスケープ ---
-				input.Data[field.Name] = html.EscapeString(str)
-			}
-			// タグ付きフィールドの名前変更
-			if field.Tag != "" {
-				renamedData[field.Tag+"_"+field.Name] = input.Data[field.Name]
-			} else {
-				renamedData[field.Name] = input.Data[field.Name]
+// 送信履歴（record_submissions）の登録元
+const (
+	sourcePost     = "post"
+	sourceBatch    = "batch"
+	sourceImport   = "import"
+	sourceRollback = "rollback"
+)
+
+// upsertRecord: セッションを登録し、すでにあればRECORD_SCHEMAのMERGEに従ってdataを更新してIDを返す
+// あわせて、送られたランキング項目ごとに、保存されている値が登録前より良くなったか（新規の場合はtrue）を返す
+// hooksを渡した場合は、登録・1位・無効化のWebhookを同じトランザクションで登録する（インポートではnil）
+func upsertRecord(ctx context.Context, q queryer, cfg *config.Config, hooks *webhook.Dispatcher, rec sessionRecord) (int64, map[string]bool, error) {
+	// dataフィールド（map）を文字列（JSON）に変換してDBに保存できるようにする
+	jsonData, err := json.Marshal(rec.Data)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// play_countの有効無効の設定に応じた動的な変更
+	inputId := []interface{}{rec.UUID}
+	playCountAddText := [4]string{}
+	if cfg.Server.EnablePlayCount {
+		inputId = append(inputId, rec.PlayCount)
+		playCountAddText[0] = ", play_count"
+		playCountAddText[1] = ", ?"
+		playCountAddText[2] = ", play_count"
+		playCountAddText[3] = " AND play_count = ?"
+	}
+
+	// 送られたランキング項目（登録前後の値を比べる）
+	var indexFields []config.SchemaConfig
+	var indexColumns []string
+	for _, field := range cfg.Schema {
+		key := field.Name
+		if field.Tag != "" {
+			key = field.Tag + "_" + field.Name
+		}
+		if _, ok := rec.Data[key]; ok && field.IsIndex {
+			indexFields = append(indexFields, field)
+			indexColumns = append(indexColumns, fmt.Sprintf("data ->> '$.%s'", key))
+		}
+	}
+
+	// 登録前の値（新規かどうかも合わせて確認する）
+	before := make([]interface{}, len(indexFields))
+	pointers := []interface{}{new(int64)}
+	for i := range before {
+		pointers = append(pointers, &before[i])
+	}
+	query := fmt.Sprintf("SELECT %s FROM sessions WHERE uuid = ?%s",
+		strings.Join(append([]string{"id"}, indexColumns...), ", "), playCountAddText[3])
+	err = q.QueryRowContext(ctx, query, inputId...).Scan(pointers...)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, nil, err
+	}
+	created := err == sql.ErrNoRows
+
+	var playedAt interface{}
+	if rec.PlayedAt != "" {
+		playedAt = rec.PlayedAt
+	}
+	args := append(inputId, string(jsonData), rec.IP, playedAt)
+
+	// 日時の指定（インポート）があればその日時、なければ現在日時
+	createdAtText := [3]string{"", "", "CURRENT_TIMESTAMP"}
+	if rec.CreatedAt != "" {
+		createdAtText = [3]string{", created_at", ", ?", "excluded.created_at"}
+		args = append(args, rec.CreatedAt)
+	}
+
+	returning := append([]string{"id", "json(data)"}, indexColumns...)
+
+	// SQLiteの UPSERT (INSERT ... ON CONFLICT)
+	query = fmt.Sprintf(`
+		INSERT INTO sessions (uuid%s, data, ip_address, played_at%s)
+		VALUES (?%s, jsonb(?), ?, ?%s)
+		ON CONFLICT(uuid%s) DO UPDATE SET
+			data = %s,
+			played_at = COALESCE(excluded.played_at, played_at),
+			created_at = %s
+		RETURNING %s
+	`, playCountAddText[0], createdAtText[0], playCountAddText[1], createdAtText[1], playCountAddText[2],
+		mergeExpression(cfg), createdAtText[2], strings.Join(returning, ", "))
+
+	var sessionId int64
+	var stored string
+	after := make([]interface{}, len(indexFields))
+	pointers = []interface{}{&sessionId, &stored}
+	for i := range after {
+		pointers = append(pointers, &after[i])
+	}
+	if err := q.QueryRowContext(ctx, query, args...).Scan(pointers...); err != nil {
+		return 0, nil, err
+	}
+
+	if rec.Disable {
+		if _, err := q.ExecContext(ctx, "UPDATE sessions SET disable = TRUE WHERE id = ?", sessionId); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// 送信履歴を追記する（送られた内容と、MERGE後に保存された内容）
+	if err := recordSubmission(ctx, q, sessionId, string(jsonData), rec.IP, rec.IdemKey, rec.Source, rec.CreatedAt); err != nil {
+		return 0, nil, err
+	}
+
+	improved := make(map[string]bool, len(indexFields))
+	for i, field := range indexFields {
+		improved[field.Name] = isImproved(field, before[i], after[i])
+	}
+
+	if hooks != nil {
+		notice := recordNotice{
+			SessionID: sessionId,
+			Record:    rec,
+			Created:   created,
+			Data:      json.RawMessage(stored),
+			Fields:    indexFields,
+			After:     after,
+			Improved:  improved,
+		}
+		if err := enqueueRecordWebhooks(ctx, q, hooks, notice); err != nil {
+			return 0, nil, err
+		}
+	}
+	return sessionId, improved, nil
+}
+
+// mergeExpression: ON CONFLICTで既存のdata（data）と新しいdata（excluded.data）を合わせる式
+// replace以外の項目は、上書きした後でMERGEに従った値に置き換える
+// （json_patchでNULLの値はキーの削除になるため、どちらにも値がない項目は作られない）
+func mergeExpression(cfg *config.Config) string {
+	var pairs []string
+	for _, field := range cfg.Schema {
+		key := field.Name
+		if field.Tag != "" {
+			key = field.Tag + "_" + field.Name
+		}
+		prev := fmt.Sprintf("data ->> '$.%s'", key)
+		next := fmt.Sprintf("excluded.data ->> '$.%s'", key)
+
+		merge := field.Merge
+		if merge == "keep_best" {
+			merge = "max"
+			if field.Order == "ASC" {
+				merge = "min"
 			}
 		}
+		var expr string
+		switch merge {
+		case "keep_first":
+			expr = fmt.Sprintf("COALESCE(%s, %s)", prev, next)
+		case "max", "min":
+			// max(), min() はどちらかがNULLだとNULLになる
+			expr = fmt.Sprintf("COALESCE(%s(%s, %s), %s, %s)", merge, prev, next, prev, next)
+		case "sum":
+			expr = fmt.Sprintf("CASE WHEN %s IS NULL THEN %s ELSE COALESCE(%s, 0) + %s END", next, prev, prev, next)
+		default:
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("'%s', %s", key, expr))
+	}
 
-		// dataフィールド（map）を文字列（JSON）に変換してDBに保存できるようにする
-		jsonData, _ := json.Marshal(renamedData)
+	if len(pairs) == 0 {
+		return "jsonb_patch(data, excluded.data)"
+	}
+	return fmt.Sprintf("jsonb_patch(jsonb_patch(data, excluded.data), json_object(%s))", strings.Join(pairs, ", "))
+}
 
-		// play_countの有効無効の設定に応じた動的な変更
-		inputId := []interface{}{input.UUID}
-		playCountAddText := [3]string{}
-		if cfg.Server.EnablePlayCount {
-			inputId = append(inputId, input.PlayCount)
-			playCountAddText[0] = ", play_count"
-			playCountAddText[1] = ", ?"
-			playCountAddText[2] = ", play_count"
+// 登録後の値が登録前より良くなったか（ORDERがDESCなら大きいほど、ASCなら小さいほど良い）
+func isImproved(field config.SchemaConfig, before, after interface{}) bool {
+	if after == nil {
+		return false
+	}
+	if before == nil {
+		return true
+	}
+	b, okB := toFloat(before)
+	a, okA := toFloat(after)
+	if !okB || !okA {
+		return false
+	}
+	if field.Order == "ASC" {
+		return a < b
+	}
+	return a > b
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// validateRecordData: config.yamlのRECORD_SCHEMAに従ってdataを検証し、DB上の名前（タグ付きは{TAG}_{NAME}）に変換する
+func validateRecordData(cfg *config.Config, tag string, data map[string]interface{}) (map[string]interface{}, error) {
+	renamedData := make(map[string]interface{})
+	for _, field := range cfg.Schema {
+		// タグが設定されていてかつ異なったら無視
+		if field.Tag != "" && field.Tag != tag {
+			continue
 		}
-		// SQLiteの UPSERT (INSERT ... ON CONFLICT)
-		query := fmt.Sprintf(`
-			INSERT INTO sessions (uuid%s, data, ip_address)
-			VALUES (?%s, jsonb(?), ?)
-			ON CONFLICT(uuid%s) DO UPDATE SET
-				data = jsonb_patch(data, excluded.data),
-				created_at = CURRENT_TIMESTAMP
-			RETURNING id
-		`, playCountAddText[0], playCountAddText[1], playCountAddText[2])
 
-		var sessionId int64
-		err := db.QueryRow(query, append(inputId, string(jsonData), middleware.GetTrustedIP(c, cfg))...).Scan(&sessionId)
+		val, exists := data[field.Name]
+		if !exists {
+			return nil, fmt.Errorf("Missing required field: %s", field.Name)
+		}
 
+		val, err := checkFieldValue(cfg, field, val)
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Record insert failed"})
+			return nil, err
 		}
+		// タグ付きフィールドの名前変更
+		if field.Tag != "" {
+			renamedData[field.Tag+"_"+field.Name] = val
+		} else {
+			renamedData[field.Name] = val
+		}
+	}
+	return renamedData, nil
+}
 
-		return c.Status(201).JSON(fiber.Map{
-			"message":    "Record registered successfully",
-			"session_id": sessionId,
-		})
+// checkFieldValue: スキーマの型とMIN/MAXに合っているかを確認し、保存する値を返す
+func checkFieldValue(cfg *config.Config, field config.SchemaConfig, val interface{}) (interface{}, error) {
+	// 型の簡易チェック (例: INTEGERならfloat64としてパースされるので数値チェック)
+	switch true {
+	case slices.Contains(cfg.TypeValidation.Numbers, field.Type):
+		num, ok := val.(float64) // JSONの数値はGoではfloat64としてパースされる
+		if !ok {
+			return nil, fmt.Errorf("%s must be a number", field.Name)
+		}
+
+		// min / max チェック
+		if field.Min != nil && int(num) < *field.Min {
+			return nil, fmt.Errorf("%s must be >= %d", field.Name, *field.Min)
+		}
+		if field.Max != nil && int(num) > *field.Max {
+			return nil, fmt.Errorf("%s must be <= %d", field.Name, *field.Max)
+		}
+
+	case slices.Contains(cfg.TypeValidation.Strings, field.Type):
+		str, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a string", field.Name)
+		}
+
+		// min / max チェック
+		if field.Min != nil && len([]rune(str)) < *field.Min {
+			return nil, fmt.Errorf("length of %s must be >= %d", field.Name, *field.Min)
+		}
+		if field.Max != nil && len([]rune(str)) > *field.Max {
+			return nil, fmt.Errorf("length of %s must be <= %d", field.Name, *field.Max)
+		}
+		// 送られた文字列をそのまま保存する（HTMLエスケープは出力時に ?escape=html で行う）
 	}
+	return val, nil
 }
 
 // レコードの無効化・有効化
-func DisableRecord(db *sql.DB) fiber.Handler {
+func DisableRecord(db *sql.DB, cfg *config.Config, broker *events.Broker, hooks *webhook.Dispatcher) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		sessionId := c.Params("SessionId")
 
@@ -144,17 +514,44 @@ func DisableRecord(db *sql.DB) fiber.Handler {
 			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		// データベース更新
-		result, err := db.Exec("UPDATE sessions SET disable = ? WHERE id = ?", req.Disable, sessionId)
+		// 無効化の通知（Webhook）を同じトランザクションで登録する
+		ctx := c.UserContext()
+		tx, err := db.BeginTx(ctx, nil)
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to update record"})
+			return c.Status(500).JSON(fiber.Map{"error": "Transaction failed"})
 		}
+		defer tx.Rollback()
 
-		// 該当レコードが存在したかチェック
-		rowsAffected, _ := result.RowsAffected()
-		if rowsAffected == 0 {
+		// play_countの有効無効の設定に応じた動的な変更（無効の場合はnullとして通知する）
+		var uuid string
+		var playCount *int
+		returning := []interface{}{&uuid}
+		playCountAddText := ""
+		if cfg.Server.EnablePlayCount {
+			returning = append(returning, &playCount)
+			playCountAddText = ", play_count"
+		}
+
+		// データベース更新（該当レコードが存在しない場合はsql.ErrNoRows）
+		err = tx.QueryRowContext(ctx, fmt.Sprintf("UPDATE sessions SET disable = ? WHERE id = ? RETURNING uuid%s", playCountAddText),
+			req.Disable, sessionId).Scan(returning...)
+		if err == sql.ErrNoRows {
 			return c.Status(404).JSON(fiber.Map{"error": "Session not found"})
 		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update record"})
+		}
+
+		id, _ := strconv.ParseInt(sessionId, 10, 64)
+		if req.Disable {
+			if err := enqueueDisabled(ctx, tx, hooks, id, uuid, playCount, disabledByAdmin); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to update record"})
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		broker.Publish(events.TopicRecords, events.RecordEvent{Action: "disable", SessionID: id})
 
 		statusMsg := "enabled"
 		if req.Disable {
@@ -169,211 +566,281 @@ func DisableRecord(db *sql.DB) fiber.Handler {
 	}
 }
 
-// レコードの取得
-func GetRecords(db *sql.DB, cfg *config.Config, detail bool) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		// ランキング有効チェック
-		if len(cfg.Schema) == 0 {
-			return c.JSON(fiber.Map{
-				"message": "Ranking is disabled",
-				"data":    []interface{}{},
-			})
+// ランキングの取得条件（GetRecordsとランキングのストリーミングで共通）
+type rankingQuery struct {
+	Tag       string // タグ指定なしの場合は global
+	SortBy    string // DB上の名前
+	Order     string
+	Detail    bool // 管理者向けの詳細情報を含めるか
+	Since     *time.Time
+	Limit     int
+	Offset    int
+	IsReverse bool
+	UUIDs     []string // グループのランキングの場合、対象のプレイヤー（nilは全員）
+	Escape    bool     // 配信する内容をHTMLエスケープするか（ストリームの ?escape=html）
+}
+
+// resolveSortKey: sort_byを検証し、ソートに使うDB上の名前と順序を返す
+func resolveSortKey(cfg *config.Config, tag, sortBy string) (string, config.SortOption, bool) {
+	var currentSort config.SortOption
+	found := false
+	if tag == "global" {
+		for _, opt := range cfg.SortableColumns[tag] {
+			if opt.Name == sortBy {
+				currentSort = opt
+				found = true
+				break
+			}
 		}
-		tag := c.Params("Tag")
-		if tag == "" {
-			tag = "global"
-		} else if len(cfg.SortableColumns[tag]) == 0 {
-			return c.JSON(fiber.Map{
-				"message": "This tag's ranking is disabled",
-				"data":    []interface{}{},
-			})
+	} else {
+		// タグ指定があった場合は、そのタグ特有のソートキーを優先する
+		for _, opt := range cfg.SortableColumns["none"] {
+			if opt.Name == sortBy {
+				currentSort = opt
+				found = true
+				break
+			}
 		}
+		for _, opt := range cfg.SortableColumns[tag] {
+			if opt.Name == sortBy {
+				currentSort = opt
+				found = true
+				// タグ特有のソートキーの場合、DB上の名称に変換
+				sortBy = tag + "_" + sortBy
+				break
+			}
+		}
+	}
+	return sortBy, currentSort, found
+}
 
-		// sort_by の取得と検証
-		sortBy := c.Query("sort_by", cfg.SortableColumns[tag][0].Name)
-
-		var currentSort config.SortOption
-		var sortKey []config.SortOption
+// sortOptionsFor: レスポンスのメタデータ（UI側はこの配列を見てタブやボタンを作れる）
+func sortOptionsFor(cfg *config.Config, tag string) []config.SortOption {
+	var sortOptions []config.SortOption
+	if tag != "global" {
+		sortOptions = cfg.SortableColumns["none"]
+	}
+	return append(sortOptions, cfg.SortableColumns[tag]...)
+}
 
-		// 管理者用ソートキーの追加
-		if detail {
-			sortKey = append(sortKey,
-				config.SortOption{Name: "id", Order: ""},
-				config.SortOption{Name: "created_at", Order: ""},
-			)
+// fetchRanking: 条件に合うランキングを取得する
+func fetchRanking(ctx context.Context, db *sql.DB, cfg *config.Config, q rankingQuery) ([]fiber.Map, error) {
+	var selectColumns []string
+	var where string
+	// 管理者向けの/records/detailなら詳細情報を表示
+	if q.Detail {
+		selectColumns = []string{"id", "uuid", "ip_address", "disable", "created_at", "played_at"}
+		if cfg.Server.EnablePlayCount {
+			selectColumns = append(selectColumns, "play_count")
 		}
+	} else {
+		where = "WHERE disable = FALSE"
+	}
 
-		found := false
-		if tag == "global" {
-			for _, opt := range cfg.SortableColumns[tag] {
-				if opt.Name == sortBy {
-					currentSort = opt
-					found = true
-					break
-				}
-			}
+	var args []interface{}
+
+	// 期間絞り込みロジック
+	if q.Since != nil {
+		if where == "" {
+			where = "WHERE created_at >= ?"
 		} else {
-			// タグ指定があった場合は、そのタグ特有のソートキーを優先する
-			for _, opt := range cfg.SortableColumns["none"] {
-				if opt.Name == sortBy {
-					currentSort = opt
-					found = true
-					break
-				}
-			}
-			for _, opt := range cfg.SortableColumns[tag] {
-				if opt.Name == sortBy {
-					currentSort = opt
-					found = true
-					// タグ特有のソートキーの場合、DB上の名称に変換
-					sortBy = tag + "_" + sortBy
-					break
-				}
-			}
+			where += " AND created_at >= ?"
 		}
+		args = append(args, *q.Since)
+	}
 
-		if !found {
-			return c.Status(400).JSON(fiber.Map{"error": "Invalid sort key"})
+	// グループのランキング（順位もグループ内で付ける）
+	if q.UUIDs != nil {
+		uuids, err := json.Marshal(q.UUIDs)
+		if err != nil {
+			return nil, err
 		}
-
-		var selectColumns []string
-		var where string
-		// 管理者向けの/records/detailなら詳細情報を表示
-		if detail {
-			selectColumns = []string{"id", "uuid", "ip_address", "disable", "created_at"}
-			if cfg.Server.EnablePlayCount {
-				selectColumns = append(selectColumns, "play_count")
-			}
+		if where == "" {
+			where = "WHERE uuid IN (SELECT value FROM json_each(?))"
 		} else {
-			where = "WHERE disable = FALSE"
+			where += " AND uuid IN (SELECT value FROM json_each(?))"
 		}
+		args = append(args, string(uuids))
+	}
 
-		sinceStr := c.Query("since")
-		var args []interface{}
-
-		// 期間絞り込みロジック
-		if sinceStr != "" {
-			// 文字列を time.Time に変換
-			sinceTime, err := time.Parse(time.RFC3339, sinceStr)
-			if err != nil {
-				return c.Status(400).JSON(fiber.Map{"error": "invalid since format (use RFC3339)"})
-			}
-			if where == "" {
-				where = "WHERE created_at >= ?"
-			} else {
-				where += " AND created_at >= ?"
+	if q.Tag == "global" {
+		for _, field := range cfg.Schema {
+			// タグ指定なしの場合、global := タグ無し + IsGlobalフラグ付きの列を取得
+			if field.Tag != "" && !field.IsGlobal {
+				continue
 			}
-			args = append(args, sinceTime)
+			col := fmt.Sprintf("(data ->> '$.%s') AS %s", field.Name, field.Name)
+			selectColumns = append(selectColumns, col)
 		}
-
-		if tag == "global" {
-			for _, field := range cfg.Schema {
-				// タグ指定なしの場合、global := タグ無し + IsGlobalフラグ付きの列を取得
-				if field.Tag != "" && !field.IsGlobal {
-					continue
-				}
+	} else {
+		for _, field := range cfg.Schema {
+			// タグ指定有りの場合、タグ無しとタグ一致の列を取得
+			switch field.Tag {
+			case "":
 				col := fmt.Sprintf("(data ->> '$.%s') AS %s", field.Name, field.Name)
 				selectColumns = append(selectColumns, col)
-			}
-		} else {
-			for _, field := range cfg.Schema {
-				// タグ指定有りの場合、タグ無しとタグ一致の列を取得
-				switch field.Tag {
-				case "":
-					col := fmt.Sprintf("(data ->> '$.%s') AS %s", field.Name, field.Name)
-					selectColumns = append(selectColumns, col)
-				case tag:
-					col := fmt.Sprintf("(data ->> '$.%s') AS %s", tag+"_"+field.Name, field.Name)
-					selectColumns = append(selectColumns, col)
-				}
+			case q.Tag:
+				col := fmt.Sprintf("(data ->> '$.%s') AS %s", q.Tag+"_"+field.Name, field.Name)
+				selectColumns = append(selectColumns, col)
 			}
 		}
+	}
 
-		isReverse, _ := strconv.ParseBool(c.Query("is_reverse"))
-		finalOrder := currentSort.Order
-		useRank := true
-		if isReverse {
-			switch finalOrder {
-			case "DESC":
-				finalOrder = "ASC"
-			case "ASC":
-				finalOrder = "DESC"
-			default:
-				// 管理者用ソートキーなど、ランクが必要なくASC固定
-				finalOrder = "ASC"
-				useRank = false
-			}
+	// プレイヤープロフィール（名前の変更がすべての行に反映される）
+	selectColumns = append(selectColumns,
+		fmt.Sprintf("(SELECT %s FROM players WHERE players.uuid = sessions.uuid) AS player", playerObjectColumns))
+
+	finalOrder := q.Order
+	useRank := true
+	if q.IsReverse {
+		switch finalOrder {
+		case "DESC":
+			finalOrder = "ASC"
+		case "ASC":
+			finalOrder = "DESC"
+		default:
+			// 管理者用ソートキーなど、ランクが必要なくASC固定
+			finalOrder = "ASC"
+			useRank = false
 		}
+	}
 
-		// 順位の付与
-		if useRank {
-			rankCol := fmt.Sprintf("RANK() OVER (ORDER BY %s %s) AS rank", sortBy, finalOrder)
-			selectColumns = append([]string{rankCol}, selectColumns...)
-		}
+	// 順位の付与
+	if useRank {
+		rankCol := fmt.Sprintf("RANK() OVER (ORDER BY %s %s) AS rank", q.SortBy, finalOrder)
+		selectColumns = append([]string{rankCol}, selectColumns...)
+	}
 
-		selection := strings.Join(selectColumns, ", ")
+	selection := strings.Join(selectColumns, ", ")
 
-		// limit, offsetの取得
-		limit := c.QueryInt("limit", 10)
-		offset := c.QueryInt("offset", 0)
+	// クエリの組み立て
+	query := fmt.Sprintf(
+		"SELECT %s FROM sessions %s ORDER BY %s %s NULLS LAST LIMIT %d OFFSET %d",
+		selection, where, q.SortBy, finalOrder, q.Limit, q.Offset,
+	)
 
-		if limit < 0 || offset < 0 {
-			return c.Status(400).JSON(fiber.Map{"error": "limit and offset must be positive"})
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// レスポンスの成形
+	// カラム名の一覧を取得
+	cols, _ := rows.Columns()
+	var results []fiber.Map
+	for rows.Next() {
+		// データの受け皿を動的に作成
+		columns := make([]interface{}, len(cols))
+		columnPointers := make([]interface{}, len(cols))
+		for i := range columns {
+			columnPointers[i] = &columns[i]
 		}
 
-		// 最大値の制限（負荷対策）
-		if limit > cfg.Server.ReadLimit {
-			limit = cfg.Server.ReadLimit
+		// スキャン
+		if err := rows.Scan(columnPointers...); err != nil {
+			return nil, err
 		}
 
-		// クエリの組み立て
-		query := fmt.Sprintf(
-			"SELECT %s FROM sessions %s ORDER BY %s %s NULLS LAST LIMIT %d OFFSET %d",
-			selection, where, sortBy, finalOrder, limit, offset,
-		)
+		// Mapに変換
+		rowData := make(fiber.Map)
+		for i, colName := range cols {
+			rowData[colName] = columns[i]
+		}
+		// プロフィールはJSONの文字列で取り出しているのでオブジェクトとして返す
+		if player, ok := rowData["player"].(string); ok {
+			rowData["player"] = json.RawMessage(player)
+		}
+		results = append(results, rowData)
+	}
+	return results, rows.Err()
+}
 
-		rows, err := db.Query(query, args...)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
-		}
-		defer rows.Close()
-
-		// レスポンスの成形
-		// カラム名の一覧を取得
-		cols, _ := rows.Columns()
-		var results []fiber.Map
-		for rows.Next() {
-			// データの受け皿を動的に作成
-			columns := make([]interface{}, len(cols))
-			columnPointers := make([]interface{}, len(cols))
-			for i := range columns {
-				columnPointers[i] = &columns[i]
-			}
+// レコードの取得
+func GetRecords(db *sql.DB, cfg *config.Config, detail bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return respondRanking(c, db, cfg, detail, nil)
+	}
+}
 
-			// スキャン
-			if err := rows.Scan(columnPointers...); err != nil {
-				return err
-			}
+// respondRanking: クエリ（sort_by, since, is_reverse, limit, offset, escape）に従ってランキングを返す
+// uuidsを指定した場合はそのプレイヤーのレコードだけのランキングになる（グループのランキング）
+func respondRanking(c *fiber.Ctx, db *sql.DB, cfg *config.Config, detail bool, uuids []string) error {
+	// ランキング有効チェック
+	if len(cfg.Schema) == 0 {
+		return c.JSON(fiber.Map{
+			"message": "Ranking is disabled",
+			"data":    []interface{}{},
+		})
+	}
+	tag := c.Params("Tag")
+	if tag == "" {
+		tag = "global"
+	} else if len(cfg.SortableColumns[tag]) == 0 {
+		return c.JSON(fiber.Map{
+			"message": "This tag's ranking is disabled",
+			"data":    []interface{}{},
+		})
+	}
 
-			// Mapに変換
-			rowData := make(fiber.Map)
-			for i, colName := range cols {
-				rowData[colName] = columns[i]
-			}
-			results = append(results, rowData)
-		}
+	escape, err := outputEscape(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
 
-		var sortOptions []config.SortOption
-		if tag != "global" {
-			sortOptions = cfg.SortableColumns["none"]
+	// sort_by の取得と検証
+	sortBy, currentSort, found := resolveSortKey(cfg, tag, c.Query("sort_by", cfg.SortableColumns[tag][0].Name))
+	if !found {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid sort key"})
+	}
+
+	q := rankingQuery{
+		Tag:    tag,
+		SortBy: sortBy,
+		Order:  currentSort.Order,
+		Detail: detail,
+		UUIDs:  uuids,
+	}
+
+	// 期間絞り込みロジック
+	if sinceStr := c.Query("since"); sinceStr != "" {
+		// 文字列を time.Time に変換
+		sinceTime, err := time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid since format (use RFC3339)"})
 		}
-		sortOptions = append(sortOptions, cfg.SortableColumns[tag]...)
-		// レスポンスにメタデータを含める
-		return c.JSON(fiber.Map{
-			"meta": sortOptions, // UI側はこの配列を見てタブやボタンを作れる
-			"data": results,
-		})
+		q.Since = &sinceTime
 	}
+
+	q.IsReverse, _ = strconv.ParseBool(c.Query("is_reverse"))
+
+	// limit, offsetの取得
+	q.Limit = c.QueryInt("limit", 10)
+	q.Offset = c.QueryInt("offset", 0)
+
+	if q.Limit < 0 || q.Offset < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "limit and offset must be positive"})
+	}
+
+	// 最大値の制限（負荷対策）
+	if q.Limit > cfg.Server.ReadLimit {
+		q.Limit = cfg.Server.ReadLimit
+	}
+
+	results, err := fetchRanking(c.UserContext(), db, cfg, q)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	// Webページに直接埋め込む場合のHTMLエスケープ
+	if escape {
+		escapeHTMLValue(results)
+	}
+
+	// レスポンスにメタデータを含める
+	return c.JSON(fiber.Map{
+		"meta": sortOptionsFor(cfg, tag), // UI側はこの配列を見てタブやボタンを作れる
+		"data": results,
+	})
 }
 
 func GetRanks(db *sql.DB, cfg *config.Config) fiber.Handler {
@@ -448,7 +915,7 @@ func GetRanks(db *sql.DB, cfg *config.Config) fiber.Handler {
 		)
 
 		var rank int
-		err := db.QueryRow(query, sessionId).Scan(&rank)
+		err := db.QueryRowContext(c.UserContext(), query, sessionId).Scan(&rank)
 		if err != nil {
 			return c.Status(404).JSON(fiber.Map{"error": "Session not found"})
 		}
@@ -0,0 +1,412 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+	"ranklogger/events"
+	"ranklogger/middleware"
+)
+
+// StreamLimiter: ストリーミング接続数の上限（SSEとWebSocketで共有する）
+type StreamLimiter struct {
+	cfg *config.Config
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func NewStreamLimiter(cfg *config.Config) *StreamLimiter {
+	return &StreamLimiter{cfg: cfg, perIP: make(map[string]int)}
+}
+
+// acquire: 接続を1つ確保する（上限に達している場合はfalse）
+func (l *StreamLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.total >= l.cfg.Stream.MaxConnections || l.perIP[ip] >= l.cfg.Stream.MaxConnectionsPerIP {
+		return false
+	}
+	l.total++
+	l.perIP[ip]++
+	return true
+}
+
+// release: 確保した接続を返す
+func (l *StreamLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// Count: 現在の接続数
+func (l *StreamLimiter) Count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+// WebSocketのハンドラーに受け渡すLocalsのキー
+const (
+	streamQueryKey = "stream_query"
+	streamIPKey    = "stream_ip"
+)
+
+// parseRankingStream: 購読するランキング（タグ、sort_by、上位何件か）を検証する
+func parseRankingStream(c *fiber.Ctx, cfg *config.Config) (rankingQuery, int, error) {
+	if len(cfg.Schema) == 0 {
+		return rankingQuery{}, 404, fmt.Errorf("Ranking is disabled")
+	}
+	tag := c.Params("Tag")
+	if tag == "" {
+		tag = "global"
+	} else if len(cfg.SortableColumns[tag]) == 0 {
+		return rankingQuery{}, 404, fmt.Errorf("This tag's ranking is disabled")
+	}
+
+	sortBy, currentSort, found := resolveSortKey(cfg, tag, c.Query("sort_by", cfg.SortableColumns[tag][0].Name))
+	if !found {
+		return rankingQuery{}, 400, fmt.Errorf("Invalid sort key")
+	}
+
+	limit := c.QueryInt("limit", 10)
+	if limit <= 0 {
+		return rankingQuery{}, 400, fmt.Errorf("limit must be positive")
+	}
+	// 最大値の制限（負荷対策）
+	if limit > cfg.Server.ReadLimit {
+		limit = cfg.Server.ReadLimit
+	}
+	escape, err := outputEscape(c)
+	if err != nil {
+		return rankingQuery{}, 400, err
+	}
+
+	return rankingQuery{
+		Tag:    tag,
+		SortBy: sortBy,
+		Order:  currentSort.Order,
+		Limit:  limit,
+		Escape: escape,
+	}, 0, nil
+}
+
+// setSSEHeaders: Server-Sent Eventsのレスポンスヘッダーを設定する
+func setSSEHeaders(c *fiber.Ctx) {
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no") // リバースプロキシでバッファリングさせない
+}
+
+// sseWriter: イベントを1つ送る関数と、ハートビートを送る関数を返す
+// ハートビートはコメント行（クライアントには無視される）で、接続の維持と切断の検知に使う
+func sseWriter(w *bufio.Writer) (send func(event string, msg []byte) error, heartbeat func() error) {
+	send = func(event string, msg []byte) error {
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, msg); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	heartbeat = func() error {
+		if _, err := w.WriteString(": heartbeat\n\n"); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	return send, heartbeat
+}
+
+// runRankingStream: 最初に上位N件を送り、レコードが変わるたびに上位N件を取り直して、変わっていれば送る
+// send が失敗した（クライアントが切断した）場合、done が閉じられた場合、Brokerが終了した場合に戻る
+func runRankingStream(db *sql.DB, cfg *config.Config, q rankingQuery, sub *events.Subscription, done <-chan struct{},
+	send func(event string, msg []byte) error, heartbeat func() error) {
+	minInterval := time.Duration(cfg.Stream.MinIntervalMs) * time.Millisecond
+	ticker := time.NewTicker(time.Duration(cfg.Stream.HeartbeatSeconds) * time.Second)
+	defer ticker.Stop()
+
+	var last []byte
+	push := func(event string) error {
+		results, err := fetchRanking(context.Background(), db, cfg, q)
+		if err != nil {
+			log.Printf("Ranking stream query failed: %v", err)
+			return nil
+		}
+		// Webページに直接埋め込む場合のHTMLエスケープ
+		if q.Escape {
+			escapeHTMLValue(results)
+		}
+		data, err := json.Marshal(results)
+		if err != nil {
+			return err
+		}
+		// 上位N件に変化がなければ送らない
+		if last != nil && bytes.Equal(data, last) {
+			return nil
+		}
+		last = data
+		msg, err := json.Marshal(fiber.Map{
+			"type": event,
+			"tag":  q.Tag,
+			"meta": sortOptionsFor(cfg, q.Tag),
+			"data": json.RawMessage(data),
+		})
+		if err != nil {
+			return err
+		}
+		return send(event, msg)
+	}
+
+	if err := push("snapshot"); err != nil {
+		return
+	}
+	lastPush := time.Now()
+	for {
+		select {
+		case _, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			// 短い間隔で続いた変更は、待っている間に1つにまとめられる
+			if wait := minInterval - time.Since(lastPush); wait > 0 {
+				time.Sleep(wait)
+			}
+			if err := push("update"); err != nil {
+				return
+			}
+			lastPush = time.Now()
+		case <-ticker.C:
+			if err := heartbeat(); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// StreamRecords: ランキングの上位N件をServer-Sent Eventsで配信する
+// 接続時に snapshot、上位N件が変わるたびに update のイベントを送る
+func StreamRecords(db *sql.DB, cfg *config.Config, broker *events.Broker, limiter *StreamLimiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		q, status, err := parseRankingStream(c, cfg)
+		if err != nil {
+			return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+		}
+		ip := middleware.GetTrustedIP(c, cfg)
+		if !limiter.acquire(ip) {
+			return c.Status(429).JSON(fiber.Map{"error": "Too many stream connections"})
+		}
+
+		setSSEHeaders(c)
+
+		// SetBodyStreamWriterの中はハンドラーが返った後に実行されるため、cは使わない
+		sub := broker.Subscribe(events.TopicRecords, 1)
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer limiter.release(ip)
+			defer sub.Close()
+
+			send, heartbeat := sseWriter(w)
+			runRankingStream(db, cfg, q, sub, nil, send, heartbeat)
+		})
+		return nil
+	}
+}
+
+// RecordsWebSocketUpgrade: WebSocketへのアップグレード要求と購読内容を確認し、接続を確保する
+// 確保した接続はWebSocketRecordsが終了したときに返す
+func RecordsWebSocketUpgrade(cfg *config.Config, limiter *StreamLimiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !websocket.IsWebSocketUpgrade(c) {
+			return c.Status(426).JSON(fiber.Map{"error": "WebSocket upgrade required"})
+		}
+		q, status, err := parseRankingStream(c, cfg)
+		if err != nil {
+			return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+		}
+		ip := middleware.GetTrustedIP(c, cfg)
+		if !limiter.acquire(ip) {
+			return c.Status(429).JSON(fiber.Map{"error": "Too many stream connections"})
+		}
+		c.Locals(streamQueryKey, q)
+		c.Locals(streamIPKey, ip)
+
+		if err := c.Next(); err != nil {
+			// アップグレードに失敗した場合はWebSocketRecordsが呼ばれない
+			limiter.release(ip)
+			return err
+		}
+		return nil
+	}
+}
+
+// WebSocketRecords: ランキングの上位N件をWebSocketで配信する（メッセージの内容はSSEと同じ）
+// ハートビートにはPingを使う
+func WebSocketRecords(db *sql.DB, cfg *config.Config, broker *events.Broker, limiter *StreamLimiter) func(*websocket.Conn) {
+	return func(conn *websocket.Conn) {
+		q := conn.Locals(streamQueryKey).(rankingQuery)
+		ip := conn.Locals(streamIPKey).(string)
+		defer limiter.release(ip)
+
+		sub := broker.Subscribe(events.TopicRecords, 1)
+		defer sub.Close()
+
+		// クライアントからのメッセージは使わないが、切断（Closeフレーム）の検知のために読み続ける
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		writeWait := time.Duration(cfg.Stream.HeartbeatSeconds) * time.Second
+		send := func(event string, msg []byte) error {
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			return conn.WriteMessage(websocket.TextMessage, msg)
+		}
+		heartbeat := func() error {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+		}
+		runRankingStream(db, cfg, q, sub, done, send, heartbeat)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	}
+}
+
+// logTailFilter: ログのライブ表示の絞り込み条件（指定がない条件は無視する）
+type logTailFilter struct {
+	SessionID int64
+	UUID      string
+	Types     []int
+	Contains  string // 大文字・小文字を区別しない部分一致
+}
+
+func (f logTailFilter) match(ev events.LogEvent, l events.LogEntry) bool {
+	if f.SessionID != 0 && ev.SessionID != f.SessionID {
+		return false
+	}
+	if f.UUID != "" && ev.UUID != f.UUID {
+		return false
+	}
+	if len(f.Types) > 0 && !slices.Contains(f.Types, l.Type) {
+		return false
+	}
+	return f.Contains == "" || strings.Contains(strings.ToLower(l.Content), f.Contains)
+}
+
+// StreamLogs: POST /logs で登録されたログをServer-Sent Eventsで流す（管理者用）
+// 絞り込み条件に合うログを1件ずつ log のイベントで送る。過去のログは GET /logs/:SessionId で取得する
+func StreamLogs(cfg *config.Config, broker *events.Broker, limiter *StreamLimiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logTypes, err := parseLogTypes(c, cfg)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		f := logTailFilter{
+			SessionID: int64(c.QueryInt("session_id", 0)),
+			UUID:      c.Query("uuid"),
+			Types:     logTypes,
+			Contains:  strings.ToLower(c.Query("q")),
+		}
+		if f.SessionID < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "session_id must be positive"})
+		}
+		escape, err := outputEscape(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		ip := middleware.GetTrustedIP(c, cfg)
+		if !limiter.acquire(ip) {
+			return c.Status(429).JSON(fiber.Map{"error": "Too many stream connections"})
+		}
+
+		setSSEHeaders(c)
+
+		// ログが続けて届いても取りこぼさないように、レコードの購読より大きめのバッファを持つ
+		sub := broker.Subscribe(events.TopicLogs, 256)
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer limiter.release(ip)
+			defer sub.Close()
+
+			send, heartbeat := sseWriter(w)
+			ticker := time.NewTicker(time.Duration(cfg.Stream.HeartbeatSeconds) * time.Second)
+			defer ticker.Stop()
+
+			// 接続できたことをすぐにクライアントに伝える
+			if err := heartbeat(); err != nil {
+				return
+			}
+			var dropped int64
+			for {
+				select {
+				case e, ok := <-sub.C:
+					if !ok {
+						return
+					}
+					ev := e.Data.(events.LogEvent)
+					for _, l := range ev.Logs {
+						if !f.match(ev, l) {
+							continue
+						}
+						entry := fiber.Map{
+							"id":         l.ID,
+							"session_id": ev.SessionID,
+							"uuid":       ev.UUID,
+							"play_count": ev.PlayCount,
+							"type":       l.Type,
+							"content":    l.Content,
+							"created_at": l.CreatedAt,
+						}
+						setLogTypeInfo(cfg, entry, l.Type)
+						if l.Data != nil {
+							entry["data"] = l.Data
+						}
+						if escape {
+							escapeHTMLValue(entry)
+						}
+						msg, err := json.Marshal(entry)
+						if err != nil {
+							return
+						}
+						if err := send("log", msg); err != nil {
+							return
+						}
+					}
+					// 送信が追いつかずに捨てた通知があれば知らせる（抜けたログは GET /logs/:SessionId で取り直せる）
+					if n := sub.Dropped(); n > dropped {
+						msg, _ := json.Marshal(fiber.Map{"dropped": n - dropped})
+						if err := send("dropped", msg); err != nil {
+							return
+						}
+						dropped = n
+					}
+				case <-ticker.C:
+					if err := heartbeat(); err != nil {
+						return
+					}
+				}
+			}
+		})
+		return nil
+	}
+}
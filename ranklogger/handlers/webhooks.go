@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+	"ranklogger/events"
+	"ranklogger/models"
+	"ranklogger/webhook"
+)
+
+// 無効化の理由（record.disabled のreason）
+const (
+	disabledByFilter = "content_filter"
+	disabledByAdmin  = "admin"
+)
+
+// recordNotice: upsertRecordで登録したレコードの、Webhookに必要な情報
+type recordNotice struct {
+	SessionID int64
+	Record    sessionRecord
+	Created   bool
+	Data      json.RawMessage // MERGE後に保存された内容（DB上の名前）
+	Fields    []config.SchemaConfig
+	After     []interface{} // Fieldsの登録後の値
+	Improved  map[string]bool
+}
+
+// enqueueRecordWebhooks: 新規登録（record.created）、1位の更新（record.new_top）、無効化（record.disabled）を通知する
+// 1位は、値が良くなった項目ごとに、有効なレコードの中で先頭（同じ値の場合は先に登録されたもの）になったかで判定する
+func enqueueRecordWebhooks(ctx context.Context, q queryer, hooks *webhook.Dispatcher, n recordNotice) error {
+	rec := n.Record
+	if n.Created {
+		err := hooks.Enqueue(ctx, q, webhook.EventRecordCreated, fiber.Map{
+			"session_id": n.SessionID,
+			"uuid":       rec.UUID,
+			"play_count": rec.PlayCount,
+			"source":     rec.Source,
+			"data":       n.Data,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if rec.Disable {
+		return enqueueDisabled(ctx, q, hooks, n.SessionID, rec.UUID, rec.PlayCount, disabledByFilter)
+	}
+
+	if !hooks.Wants(webhook.EventRecordNewTop) {
+		return nil
+	}
+	for i, field := range n.Fields {
+		if !n.Improved[field.Name] {
+			continue
+		}
+		key := field.Name
+		if field.Tag != "" {
+			key = field.Tag + "_" + field.Name
+		}
+		var topId int64
+		query := fmt.Sprintf(
+			"SELECT id FROM sessions WHERE disable = FALSE AND %s IS NOT NULL ORDER BY %s %s, id ASC LIMIT 1",
+			key, key, field.Order)
+		if err := q.QueryRowContext(ctx, query).Scan(&topId); err != nil {
+			return err
+		}
+		if topId != n.SessionID {
+			continue
+		}
+		err := hooks.Enqueue(ctx, q, webhook.EventRecordNewTop, fiber.Map{
+			"session_id": n.SessionID,
+			"uuid":       rec.UUID,
+			"play_count": rec.PlayCount,
+			"tag":        field.Tag,
+			"sort_by":    field.Name,
+			"order":      field.Order,
+			"value":      n.After[i],
+			"data":       n.Data,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueueDisabled: レコードの無効化（record.disabled）を通知する
+func enqueueDisabled(ctx context.Context, q queryer, hooks *webhook.Dispatcher, sessionId int64, uuid string, playCount *int, reason string) error {
+	return hooks.Enqueue(ctx, q, webhook.EventRecordDisabled, fiber.Map{
+		"session_id": sessionId,
+		"uuid":       uuid,
+		"play_count": playCount,
+		"reason":     reason,
+	})
+}
+
+// enqueueErrorLogs: WEBHOOK:ERROR_LOG_TYPESの種類のログをまとめて通知する（logs.error_type）
+func enqueueErrorLogs(ctx context.Context, q queryer, cfg *config.Config, hooks *webhook.Dispatcher, ev events.LogEvent) error {
+	var logs []fiber.Map
+	for _, l := range ev.Logs {
+		for _, t := range cfg.Webhook.ErrorLogTypes {
+			if l.Type == t {
+				entry := fiber.Map{"id": l.ID, "type": l.Type, "content": l.Content, "created_at": l.CreatedAt}
+				setLogTypeInfo(cfg, entry, l.Type)
+				if l.Data != nil {
+					entry["data"] = l.Data
+				}
+				logs = append(logs, entry)
+				break
+			}
+		}
+	}
+	if len(logs) == 0 {
+		return nil
+	}
+	return hooks.Enqueue(ctx, q, webhook.EventLogsErrorType, fiber.Map{
+		"session_id": ev.SessionID,
+		"uuid":       ev.UUID,
+		"play_count": ev.PlayCount,
+		"logs":       logs,
+	})
+}
+
+// GetWebhookDeliveries: Webhookの送信状況の一覧（管理者用、新しい順）
+func GetWebhookDeliveries(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		limit := c.QueryInt("limit", 50)
+		offset := c.QueryInt("offset", 0)
+		if limit <= 0 || offset < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "limit must be positive and offset must not be negative"})
+		}
+
+		query := `
+			SELECT id, endpoint, event, status, attempts, next_attempt_at, last_status_code, last_error, delivered_at, created_at
+			FROM webhook_deliveries WHERE 1 = 1`
+		var args []interface{}
+		for _, filter := range []string{"status", "event", "endpoint"} {
+			if v := c.Query(filter); v != "" {
+				query += fmt.Sprintf(" AND %s = ?", filter)
+				args = append(args, v)
+			}
+		}
+		query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+
+		rows, err := db.QueryContext(c.UserContext(), query, args...)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch webhook deliveries"})
+		}
+		defer rows.Close()
+
+		deliveries := []fiber.Map{}
+		for rows.Next() {
+			var id int64
+			var attempts int
+			var endpoint, event, status string
+			var nextAttemptAt, statusCode, lastError, deliveredAt, createdAt interface{} // NULLはnullとして返す
+			if err := rows.Scan(&id, &endpoint, &event, &status, &attempts, &nextAttemptAt, &statusCode, &lastError, &deliveredAt, &createdAt); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch webhook deliveries"})
+			}
+			// 送信中・送信済み・失敗したものは次の送信がない
+			if status != webhook.StatusPending {
+				nextAttemptAt = nil
+			}
+			deliveries = append(deliveries, fiber.Map{
+				"id":               id,
+				"endpoint":         endpoint,
+				"event":            event,
+				"status":           status,
+				"attempts":         attempts,
+				"next_attempt_at":  nextAttemptAt,
+				"last_status_code": statusCode,
+				"last_error":       lastError,
+				"delivered_at":     deliveredAt,
+				"created_at":       createdAt,
+			})
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch webhook deliveries"})
+		}
+		return c.JSON(fiber.Map{"deliveries": deliveries})
+	}
+}
+
+// GetWebhookDelivery: 送信内容と、すべての試行（ステータスコード、エラー、かかった時間）を返す（管理者用）
+func GetWebhookDelivery(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("Id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid delivery id"})
+		}
+		ctx := c.UserContext()
+
+		var endpoint, event, payload, status string
+		var attempts int
+		var nextAttemptAt, deliveredAt, createdAt interface{}
+		err = db.QueryRowContext(ctx, `
+			SELECT endpoint, event, payload, status, attempts, next_attempt_at, delivered_at, created_at
+			FROM webhook_deliveries WHERE id = ?`, id).
+			Scan(&endpoint, &event, &payload, &status, &attempts, &nextAttemptAt, &deliveredAt, &createdAt)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Delivery not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch webhook delivery"})
+		}
+		if status != webhook.StatusPending {
+			nextAttemptAt = nil
+		}
+
+		rows, err := db.QueryContext(ctx, `
+			SELECT attempt, status_code, error, duration_ms, created_at
+			FROM webhook_attempts WHERE delivery_id = ? ORDER BY id`, id)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch webhook attempts"})
+		}
+		defer rows.Close()
+
+		history := []fiber.Map{}
+		for rows.Next() {
+			var attempt int
+			var statusCode, sendErr, durationMs, attemptedAt interface{}
+			if err := rows.Scan(&attempt, &statusCode, &sendErr, &durationMs, &attemptedAt); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch webhook attempts"})
+			}
+			history = append(history, fiber.Map{
+				"attempt":     attempt,
+				"status_code": statusCode,
+				"error":       sendErr,
+				"duration_ms": durationMs,
+				"created_at":  attemptedAt,
+			})
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch webhook attempts"})
+		}
+
+		return c.JSON(fiber.Map{
+			"id":              id,
+			"endpoint":        endpoint,
+			"event":           event,
+			"status":          status,
+			"attempts":        attempts,
+			"next_attempt_at": nextAttemptAt,
+			"delivered_at":    deliveredAt,
+			"created_at":      createdAt,
+			"payload":         json.RawMessage(payload), // 送信した本文そのもの（署名の検証に使える）
+			"history":         history,
+		})
+	}
+}
+
+// RetryWebhookDelivery: 失敗・送信済みのものを含めて、もう一度送る（管理者用）
+func RetryWebhookDelivery(hooks *webhook.Dispatcher) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("Id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid delivery id"})
+		}
+		err = hooks.Retry(c.UserContext(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "Delivery not found"})
+		}
+		if errors.Is(err, webhook.ErrSending) {
+			return c.Status(409).JSON(fiber.Map{"error": "Delivery is being sent"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to retry webhook delivery"})
+		}
+		return c.JSON(fiber.Map{
+			"message": "Delivery queued",
+			"id":      id,
+		})
+	}
+}
+
+// PostWebhookTest: 送信先にpingのイベントを送る（管理者用、受信側の署名の検証などの確認に使う）
+func PostWebhookTest(cfg *config.Config, hooks *webhook.Dispatcher) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !cfg.Webhook.Enabled {
+			return c.Status(404).JSON(fiber.Map{"error": "Webhook is disabled"})
+		}
+		var req models.WebhookTestRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON"})
+		}
+		if err := validate.Struct(req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		id, err := hooks.Ping(c.UserContext(), req.Endpoint)
+		if errors.Is(err, webhook.ErrUnknownEndpoint) {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to queue ping"})
+		}
+		return c.Status(202).JSON(fiber.Map{
+			"message": "Ping queued",
+			"id":      id,
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -10,17 +11,22 @@ import (
 	"time"
 
 	"github.com/bytedance/sonic"
+	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/helmet"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/gofiber/swagger"
 
 	"ranklogger/config"
 	"ranklogger/database"
+	"ranklogger/events"
+	"ranklogger/filter"
 	"ranklogger/handlers"
 	"ranklogger/middleware"
+	"ranklogger/tracing"
+	"ranklogger/webhook"
 )
 
 func main() {
@@ -30,6 +36,20 @@ func main() {
 		log.Fatalf("Load config failed: %v", err)
 	}
 
+	// トレースの初期化（無効の場合は何もしない）
+	shutdownTracing, err := tracing.Init(cfg)
+	if err != nil {
+		log.Fatalf("Initialize tracing failed: %v", err)
+	}
+
+	// サブコマンド（backup, restore, import）が指定された場合は、サーバーを起動せずに実行して終了
+	if len(os.Args) > 1 {
+		if err := runCommand(cfg, os.Args[1:]); err != nil {
+			log.Fatalf("Command failed: %v", err)
+		}
+		return
+	}
+
 	// 2. データベースの初期化
 	// InitDBの中で、テーブル作成や仮想列の追加が実行されます
 	db, err := database.InitDB(cfg)
@@ -37,33 +57,58 @@ func main() {
 		log.Fatalf("Initialize DB failed: %v", err)
 	}
 
+	// 不適切な表現のフィルター（単語リストと正規表現リストの読み込み）
+	contentFilter, err := filter.New(cfg.ContentFilter)
+	if err != nil {
+		log.Fatalf("Load content filter failed: %v", err)
+	}
+
+	// レコードの変更などをストリーミング接続に通知する
+	broker := events.NewBroker()
+	streamLimiter := handlers.NewStreamLimiter(cfg)
+
+	// ランキングの値の分布（DISTRIBUTION:REFRESH_SECONDSごとに計算し直す）
+	distribution := handlers.NewDistributionCache(db, cfg)
+
+	// Webhookの送信（送信待ちはDBに保存され、失敗した場合は間隔を空けて再送する）
+	hooks := webhook.Start(db, cfg, broker)
+
+	// ログの削除やVACUUMなどの定期メンテナンスを開始
+	maintenance := database.StartMaintenance(db, cfg)
+
 	// 3. Fiberアプリのインスタンス生成
 	app := fiber.New(fiber.Config{
 		AppName:     "RankLogger API v1",
 		JSONEncoder: sonic.Marshal,
 		JSONDecoder: sonic.Unmarshal,
 		ReadTimeout: time.Duration(cfg.Server.ReadTimeout) * time.Second,
+		BodyLimit:   cfg.Server.BodyLimitMB * 1024 * 1024,
 	})
 
 	// 4. ミドルウェアの設定
 
-	// logger: アクセスログをコンソールに表示
-	app.Use(logger.New(logger.Config{
-		// swaggerはログを取らない
-		Next: func(c *fiber.Ctx) bool { return c.Path()[:5] == "/doc/" },
-		CustomTags: map[string]logger.LogFunc{
-			"real_ip": func(output logger.Buffer, c *fiber.Ctx, data *logger.Data, extraParam string) (int, error) {
-				return output.WriteString(middleware.GetTrustedIP(c, cfg))
-			},
-		},
-		TimeFormat: time.RFC3339,
-		Format:     "[AUDIT] ${time} | ${status} | ${latency} | ${real_ip} | ${method} | ${path} | ${queryParams} | ${body} | ${error} | ${resBody}\n",
-	}))
+	// requestid: リクエストごとにIDを振り、X-Request-IDヘッダーで返す
+	app.Use(requestid.New())
+
+	// 監査ログ: JSON Lines形式でアクセスログを出力
+	auditLogger, auditOut, err := middleware.AuditLogger(cfg)
+	if err != nil {
+		log.Fatalf("Initialize audit logger failed: %v", err)
+	}
+	app.Use(auditLogger)
+
+	// トレース: リクエストごとのスパンを作成
+	app.Use(tracing.Middleware())
 
 	// レイテンシ計測用statsとミドルウェア
-	latencyStats := middleware.NewLatencyStats(1000)
+	latencyStats := middleware.NewLatencyStats()
 	app.Use(middleware.NewLatencyMiddleware(latencyStats))
 
+	// ヘルスチェック（認証・レート制限の対象外にするため、リミッターより前に登録する）
+	serverState := &handlers.ServerState{}
+	app.Get("/healthz", handlers.Healthz()).Name("healthz")
+	app.Get("/readyz", handlers.Readyz(db, cfg, serverState)).Name("readyz")
+
 	// ユーザ単位のリミッター
 	app.Use(middleware.UserLimit(cfg))
 
@@ -89,26 +134,134 @@ func main() {
 	api := app.Group(cfg.Server.APIRootPath) // バージョニングをする
 
 	// ランキング
+	// ルート名は監査ログに出力される（レート制限の名前と揃えている）
 	api.Get("/records/detail/:Tag?", middleware.GlobalLimit(cfg, "get_records_detail"),
-		middleware.AdminAuth(cfg), handlers.GetRecords(db, cfg, true))
+		middleware.AdminAuth(cfg), handlers.GetRecords(db, cfg, true)).Name("get_records_detail")
 	api.Get("/records/:Tag?", middleware.GlobalLimit(cfg, "get_records"),
-		handlers.GetRecords(db, cfg, false))
+		handlers.GetRecords(db, cfg, false)).Name("get_records")
+
+	// 再送による重複登録を防ぐ（Idempotency-Keyヘッダーがある場合のみ）
+	idempotency := middleware.Idempotency(db, cfg)
+
+	// /records/:Tag? より先に登録する（batchはタグ名に使用不可）
+	api.Post("/records/batch", middleware.GlobalLimit(cfg, "post_records_batch"),
+		middleware.GameClientAuth(cfg), idempotency, handlers.PostRecordsBatch(db, cfg, contentFilter, broker, hooks)).Name("post_records_batch")
 	api.Post("/records/:Tag?", middleware.GlobalLimit(cfg, "post_records"),
-		middleware.GameClientAuth(cfg), handlers.PostRecord(db, cfg))
+		middleware.GameClientAuth(cfg), idempotency, handlers.PostRecord(db, cfg, contentFilter, broker, hooks)).Name("post_records")
 	api.Patch("/records/:SessionId", middleware.GlobalLimit(cfg, "patch_records"),
-		middleware.AdminAuth(cfg), handlers.DisableRecord(db))
+		middleware.AdminAuth(cfg), handlers.DisableRecord(db, cfg, broker, hooks)).Name("patch_records")
+	api.Get("/records/:SessionId/history", middleware.GlobalLimit(cfg, "get_records_history"),
+		middleware.AdminAuth(cfg), handlers.GetRecordHistory(db, cfg)).Name("get_records_history")
+	api.Post("/records/:SessionId/rollback", middleware.GlobalLimit(cfg, "post_records_rollback"),
+		middleware.AdminAuth(cfg), handlers.RollbackRecord(db, cfg, broker)).Name("post_records_rollback")
 	api.Get("/ranks/:SessionId", middleware.GlobalLimit(cfg, "get_ranks"),
-		middleware.GameClientAuth(cfg), handlers.GetRanks(db, cfg))
+		middleware.GameClientAuth(cfg), handlers.GetRanks(db, cfg)).Name("get_ranks")
+	api.Get("/distribution/:Tag?", middleware.GlobalLimit(cfg, "get_distribution"),
+		middleware.GameClientAuth(cfg), handlers.GetDistribution(distribution, cfg)).Name("get_distribution")
+
+	// プレイヤープロフィール
+	api.Put("/players/:UUID", middleware.GlobalLimit(cfg, "put_players"),
+		middleware.GameClientAuth(cfg), handlers.PutPlayer(db, cfg, contentFilter, broker)).Name("put_players")
+	api.Get("/players/:UUID", middleware.GlobalLimit(cfg, "get_players"),
+		middleware.GameClientAuth(cfg), handlers.GetPlayer(db)).Name("get_players")
+
+	// グループ内のランキング（フレンドやクラスなど）
+	// /groups/:GroupId より先に登録する（adminは管理者用）
+	api.Get("/groups/admin", middleware.GlobalLimit(cfg, "get_groups"),
+		middleware.AdminAuth(cfg), handlers.ListGroups(db, cfg, true)).Name("get_groups")
+	api.Post("/groups/admin", middleware.GlobalLimit(cfg, "post_groups"),
+		middleware.AdminAuth(cfg), handlers.CreateGroup(db, cfg, contentFilter, true)).Name("post_groups")
+	api.Get("/groups/admin/:GroupId", middleware.GlobalLimit(cfg, "get_groups"),
+		middleware.AdminAuth(cfg), handlers.GetGroup(db, true)).Name("get_groups")
+	api.Put("/groups/admin/:GroupId", middleware.GlobalLimit(cfg, "put_groups"),
+		middleware.AdminAuth(cfg), handlers.UpdateGroup(db, cfg, contentFilter, true)).Name("put_groups")
+	api.Delete("/groups/admin/:GroupId", middleware.GlobalLimit(cfg, "put_groups"),
+		middleware.AdminAuth(cfg), handlers.DeleteGroup(db, true)).Name("put_groups")
+	api.Get("/groups", middleware.GlobalLimit(cfg, "get_groups"),
+		middleware.GameClientAuth(cfg), handlers.ListGroups(db, cfg, false)).Name("get_groups")
+	api.Post("/groups", middleware.GlobalLimit(cfg, "post_groups"),
+		middleware.GameClientAuth(cfg), handlers.CreateGroup(db, cfg, contentFilter, false)).Name("post_groups")
+	api.Get("/groups/:GroupId", middleware.GlobalLimit(cfg, "get_groups"),
+		middleware.GameClientAuth(cfg), handlers.GetGroup(db, false)).Name("get_groups")
+	api.Put("/groups/:GroupId", middleware.GlobalLimit(cfg, "put_groups"),
+		middleware.GameClientAuth(cfg), handlers.UpdateGroup(db, cfg, contentFilter, false)).Name("put_groups")
+	api.Delete("/groups/:GroupId", middleware.GlobalLimit(cfg, "put_groups"),
+		middleware.GameClientAuth(cfg), handlers.DeleteGroup(db, false)).Name("put_groups")
+	api.Get("/groups/:GroupId/records/:Tag?", middleware.GlobalLimit(cfg, "get_groups_records"),
+		middleware.GameClientAuth(cfg), handlers.GetGroupRecords(db, cfg)).Name("get_groups_records")
+	api.Post("/leaderboards/:Tag?", middleware.GlobalLimit(cfg, "post_leaderboards"),
+		middleware.GameClientAuth(cfg), handlers.PostLeaderboard(db, cfg)).Name("post_leaderboards")
+
+	// ランキングのリアルタイム配信（上位N件が変わるたびに送る）
+	api.Get("/stream/records/:Tag?", middleware.GlobalLimit(cfg, "get_streams"),
+		handlers.StreamRecords(db, cfg, broker, streamLimiter)).Name("get_streams")
+	api.Get("/ws/records/:Tag?", middleware.GlobalLimit(cfg, "get_streams"),
+		handlers.RecordsWebSocketUpgrade(cfg, streamLimiter),
+		websocket.New(handlers.WebSocketRecords(db, cfg, broker, streamLimiter))).Name("get_streams")
 
 	// ログ
+	// /logs/search, /logs/query, /logs/aggregate は /logs/:SessionId より先に登録する
+	api.Get("/logs/search", middleware.GlobalLimit(cfg, "get_logs_search"),
+		middleware.AdminAuth(cfg), handlers.SearchLogs(db, cfg)).Name("get_logs_search")
+	api.Get("/logs/query", middleware.GlobalLimit(cfg, "get_logs_query"),
+		middleware.AdminAuth(cfg), handlers.QueryLogs(db, cfg)).Name("get_logs_query")
+	api.Get("/logs/aggregate", middleware.GlobalLimit(cfg, "get_logs_query"),
+		middleware.AdminAuth(cfg), handlers.AggregateLogs(db, cfg)).Name("get_logs_query")
 	api.Get("/logs/:SessionId", middleware.GlobalLimit(cfg, "get_logs"),
-		middleware.AdminAuth(cfg), handlers.GetLogs(db))
+		middleware.AdminAuth(cfg), handlers.GetLogs(db, cfg)).Name("get_logs")
 	api.Post("/logs", middleware.GlobalLimit(cfg, "post_logs"),
-		middleware.GameClientAuth(cfg), handlers.PostLogs(db, cfg))
+		middleware.GameClientAuth(cfg), idempotency, handlers.PostLogs(db, cfg, contentFilter, broker, hooks)).Name("post_logs")
+	api.Get("/stream/logs", middleware.GlobalLimit(cfg, "get_stream_logs"),
+		middleware.AdminAuth(cfg), handlers.StreamLogs(cfg, broker, streamLimiter)).Name("get_stream_logs")
 
 	// メトリクス
 	api.Get("/metrics", middleware.GlobalLimit(cfg, "get_metrics"),
-		middleware.AdminAuth(cfg), handlers.GetMetrics(db, latencyStats))
+		middleware.AdminAuth(cfg), handlers.GetMetrics(db, latencyStats, maintenance)).Name("get_metrics")
+	// ゲームプレイの分析
+	api.Get("/analytics/histogram", middleware.GlobalLimit(cfg, "get_analytics"),
+		middleware.AdminAuth(cfg), handlers.GetAnalyticsHistogram(db, cfg)).Name("get_analytics")
+	api.Get("/analytics/active", middleware.GlobalLimit(cfg, "get_analytics"),
+		middleware.AdminAuth(cfg), handlers.GetAnalyticsActive(db, cfg)).Name("get_analytics")
+	api.Get("/analytics/sessions", middleware.GlobalLimit(cfg, "get_analytics"),
+		middleware.AdminAuth(cfg), handlers.GetAnalyticsSessions(db, cfg)).Name("get_analytics")
+	api.Get("/analytics/log-types", middleware.GlobalLimit(cfg, "get_analytics"),
+		middleware.AdminAuth(cfg), handlers.GetAnalyticsLogTypes(db, cfg)).Name("get_analytics")
+	api.Get("/analytics/retention", middleware.GlobalLimit(cfg, "get_analytics"),
+		middleware.AdminAuth(cfg), handlers.GetAnalyticsRetention(db, cfg)).Name("get_analytics")
+	// バックアップ
+	api.Post("/backups", middleware.GlobalLimit(cfg, "post_backups"),
+		middleware.AdminAuth(cfg), handlers.PostBackup(db, cfg)).Name("post_backups")
+	api.Get("/backups", middleware.GlobalLimit(cfg, "get_backups"),
+		middleware.AdminAuth(cfg), handlers.GetBackups(cfg)).Name("get_backups")
+
+	// エクスポート（CSV, NDJSON, Parquet）
+	api.Get("/export/records/:Tag?", middleware.GlobalLimit(cfg, "get_exports"),
+		middleware.AdminAuth(cfg), handlers.ExportRecords(db, cfg)).Name("get_exports")
+	api.Get("/export/logs", middleware.GlobalLimit(cfg, "get_exports"),
+		middleware.AdminAuth(cfg), handlers.ExportLogs(db, cfg)).Name("get_exports")
+
+	// インポート（NDJSON, CSV）
+	api.Post("/import/records/:Tag?", middleware.GlobalLimit(cfg, "post_imports"),
+		middleware.AdminAuth(cfg), handlers.PostImportRecords(db, cfg, broker)).Name("post_imports")
+	api.Post("/import/logs", middleware.GlobalLimit(cfg, "post_imports"),
+		middleware.AdminAuth(cfg), handlers.PostImportLogs(db, cfg)).Name("post_imports")
+
+	// コンテンツフィルター（単語リストの再読み込み）
+	api.Post("/filter/reload", middleware.GlobalLimit(cfg, "post_filter_reload"),
+		middleware.AdminAuth(cfg), handlers.ReloadFilter(contentFilter)).Name("post_filter_reload")
+
+	// Webhook（送信状況の確認、再送、送信テスト）
+	api.Get("/webhooks/deliveries", middleware.GlobalLimit(cfg, "get_webhooks"),
+		middleware.AdminAuth(cfg), handlers.GetWebhookDeliveries(db)).Name("get_webhooks")
+	api.Get("/webhooks/deliveries/:Id", middleware.GlobalLimit(cfg, "get_webhooks"),
+		middleware.AdminAuth(cfg), handlers.GetWebhookDelivery(db)).Name("get_webhooks")
+	api.Post("/webhooks/deliveries/:Id/retry", middleware.GlobalLimit(cfg, "post_webhooks"),
+		middleware.AdminAuth(cfg), handlers.RetryWebhookDelivery(hooks)).Name("post_webhooks")
+	api.Post("/webhooks/test", middleware.GlobalLimit(cfg, "post_webhooks"),
+		middleware.AdminAuth(cfg), handlers.PostWebhookTest(cfg, hooks)).Name("post_webhooks")
+
+	api.Get("/version", middleware.GlobalLimit(cfg, "get_version"),
+		middleware.AdminAuth(cfg), handlers.GetVersion(db, cfg)).Name("get_version")
 
 	// 6. サーバーの起動
 	go func() {
@@ -127,6 +280,13 @@ func main() {
 	<-quit
 	log.Println("Gracefully shutting down...")
 
+	// /readyz を503にして、新しいリクエストが振り分けられなくなるのを待つ
+	serverState.SetShuttingDown()
+	time.Sleep(time.Duration(cfg.Health.ShutdownDelaySeconds) * time.Second)
+
+	// 接続中のストリーミング（SSE, WebSocket）を終わらせる（終わらないとShutdownが待ち続ける）
+	broker.Close()
+
 	// 8. 終了処理の期限（タイムアウト）を設定
 	// 全てのリクエストが10秒以内に終わらなければ強制終了
 	shutdownTimeout := 10 * time.Second
@@ -135,10 +295,18 @@ func main() {
 		log.Printf("error during shutdown: %v", err)
 	}
 
-	// 9. データベース接続を閉じる
+	// 9. Webhookの送信とメンテナンスを止めてから、データベース接続と監査ログの出力先を閉じる
+	hooks.Stop()
+	maintenance.Stop()
 	if err := db.Close(); err != nil {
 		log.Printf("error closing database: %v", err)
 	}
+	if err := auditOut.Close(); err != nil {
+		log.Printf("error closing audit log: %v", err)
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		log.Printf("error flushing traces: %v", err)
+	}
 
 	log.Println("Server stopped safely.")
 }
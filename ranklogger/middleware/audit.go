@@ -0,0 +1,279 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+)
+
+const redactedText = "[REDACTED]"
+
+// 監査ログ1行分（JSON Lines形式で出力する）
+type auditEntry struct {
+	Time      string            `json:"time"`
+	RequestID string            `json:"request_id,omitempty"`
+	Route     string            `json:"route"`
+	Method    string            `json:"method"`
+	Path      string            `json:"path"`
+	Query     string            `json:"query,omitempty"`
+	Status    int               `json:"status"`
+	LatencyMs float64           `json:"latency_ms"`
+	IP        string            `json:"ip"`
+	Principal string            `json:"principal"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	ResBody   string            `json:"res_body,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// AuditLogger: 構造化されたアクセス/監査ログを出力する
+// 認証情報やボディは設定に応じて伏せ字・切り詰めを行う
+func AuditLogger(cfg *config.Config) (fiber.Handler, io.Closer, error) {
+	auditCfg := cfg.AuditLog
+
+	var out io.WriteCloser = nopCloser{os.Stdout}
+	if strings.ToLower(auditCfg.Output) == "file" {
+		w, err := newRotatingWriter(auditCfg.FilePath, int64(auditCfg.MaxSizeMB)*1024*1024, auditCfg.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = w
+	}
+
+	redactHeaders := make(map[string]bool)
+	for _, h := range auditCfg.RedactHeaders {
+		redactHeaders[strings.ToLower(h)] = true
+	}
+	redactFields := make(map[string]bool)
+	for _, f := range auditCfg.RedactFields {
+		redactFields[strings.ToLower(f)] = true
+	}
+
+	var mu sync.Mutex // 1行ずつ書き込むためのロック
+
+	handler := func(c *fiber.Ctx) error {
+		if !auditCfg.Enabled {
+			return c.Next()
+		}
+		for _, prefix := range auditCfg.ExcludePaths {
+			if strings.HasPrefix(c.Path(), prefix) {
+				return c.Next()
+			}
+		}
+
+		start := time.Now()
+		chainErr := c.Next()
+
+		// ステータスを確定させるため、ここでエラーハンドラーを呼ぶ（Fiber標準のloggerと同じ方式）
+		if chainErr != nil {
+			if err := c.App().ErrorHandler(c, chainErr); err != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		entry := auditEntry{
+			Time:      start.Format(time.RFC3339),
+			Route:     routeName(c),
+			Method:    c.Method(),
+			Path:      c.Path(),
+			Query:     string(c.Request().URI().QueryString()),
+			Status:    c.Response().StatusCode(),
+			LatencyMs: float64(time.Since(start).Microseconds()) / 1000.0,
+			IP:        GetTrustedIP(c, cfg),
+			Principal: principal(c),
+		}
+		if rid, ok := c.Locals("requestid").(string); ok {
+			entry.RequestID = rid
+		}
+		if chainErr != nil {
+			entry.Error = chainErr.Error()
+		}
+
+		if auditCfg.LogHeaders {
+			entry.Headers = make(map[string]string)
+			c.Request().Header.VisitAll(func(key, value []byte) {
+				name := string(key)
+				if redactHeaders[strings.ToLower(name)] {
+					entry.Headers[name] = redactedText
+				} else {
+					entry.Headers[name] = truncate(string(value), auditCfg.MaxBodyBytes)
+				}
+			})
+		}
+
+		if auditCfg.LogBodies {
+			entry.Body = redactBody(c.Body(), redactFields, auditCfg.MaxBodyBytes)
+			// ストリーミングのレスポンス（エクスポートなど）はBody()で全体を読み込んでしまうので記録しない
+			if !c.Response().IsBodyStream() {
+				entry.ResBody = redactBody(c.Response().Body(), redactFields, auditCfg.MaxBodyBytes)
+			}
+		}
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil
+		}
+		mu.Lock()
+		_, _ = out.Write(append(line, '\n'))
+		mu.Unlock()
+
+		return nil
+	}
+
+	return handler, out, nil
+}
+
+// ルート名（main.goで.Name()を付けたもの）、なければルート定義のパス
+func routeName(c *fiber.Ctx) string {
+	route := c.Route()
+	if route.Name != "" {
+		return route.Name
+	}
+	return route.Path
+}
+
+// 認証を通過した主体（パスワードやAPIキーそのものは出力しない）
+func principal(c *fiber.Ctx) string {
+	if user, ok := c.Locals("username").(string); ok && user != "" {
+		return "admin:" + user
+	}
+	if _, ok := c.Locals("token").(string); ok {
+		return "game_client"
+	}
+	return "anonymous"
+}
+
+// JSONボディなら指定キーの値を伏せ字にし、最後に長さを切り詰める
+func redactBody(body []byte, fields map[string]bool, limit int) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if len(fields) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err == nil {
+			if b, err := json.Marshal(redactValue(v, fields)); err == nil {
+				body = b
+			}
+		}
+	}
+	return truncate(string(body), limit)
+}
+
+func redactValue(v interface{}, fields map[string]bool) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if fields[strings.ToLower(k)] {
+				val[k] = redactedText
+			} else {
+				val[k] = redactValue(child, fields)
+			}
+		}
+	case []interface{}:
+		for i, child := range val {
+			val[i] = redactValue(child, fields)
+		}
+	}
+	return v
+}
+
+func truncate(s string, limit int) string {
+	if limit <= 0 || len(s) <= limit {
+		return s
+	}
+	// マルチバイト文字の途中で切らないように、文字の先頭まで戻す
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s...(truncated %d bytes)", s[:cut], len(s)-cut)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// サイズでローテーションするファイル出力
+// path が上限を超えたら path.1, path.2 ... とずらし、maxBackupsを超えた分は削除する
+type rotatingWriter struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingWriter(path string, maxSize int64, maxBackups int) (*rotatingWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	w := &rotatingWriter{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	// path.N-1 → path.N, ..., path → path.1 とずらす（MAX_BACKUPSを超えるものは削除）
+	if w.maxBackups <= 0 {
+		_ = os.Remove(w.path)
+	} else {
+		_ = os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxBackups))
+		for i := w.maxBackups - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		_ = os.Rename(w.path, w.path+".1")
+	}
+	return w.open()
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize && w.size > 0 {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+
+	"ranklogger/config"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+
+	// 処理中のまま残っているキー（処理中にサーバーが停止した場合など）は、この秒数が経てば再実行を認める
+	idempotencyPendingSeconds = 60
+)
+
+// IdempotencyKey: リクエストのIdempotency-Key（ない場合は空）
+func IdempotencyKey(c *fiber.Ctx) string {
+	return c.Get(idempotencyKeyHeader)
+}
+
+// scopedIdempotencyKey: 保存するキー（認証した主体とルートごとに分ける）
+// 回線の切り替えで再送元のIPアドレスが変わっても同じキーとして扱えるように、IPアドレスは含めない
+// （別のプレイヤーが同じキーを送った場合は、ボディが違えば409、同じなら同じレスポンスになる）
+func scopedIdempotencyKey(c *fiber.Ctx, key string) string {
+	return fmt.Sprintf("%s %s\n%s", principal(c), routeName(c), key)
+}
+
+// Idempotency: Idempotency-Keyヘッダーが付いたリクエストのレスポンスを保存し、再送された場合は処理せずに同じレスポンスを返す
+// キーは認証した主体とルートごとに区別する
+// 同じキーで内容（メソッド、パス、ボディ）が異なるリクエストが来た場合は409を返す
+// 5xxのレスポンスは保存しない（再送で再実行できるようにする）
+func Idempotency(db *sql.DB, cfg *config.Config) fiber.Handler {
+	window := fmt.Sprintf("-%d hours", cfg.Idempotency.WindowHours)
+	pending := fmt.Sprintf("-%d seconds", idempotencyPendingSeconds)
+
+	return func(c *fiber.Ctx) error {
+		key := c.Get(idempotencyKeyHeader)
+		if !cfg.Idempotency.Enabled || key == "" {
+			return c.Next()
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Idempotency-Key must be <= %d characters", maxIdempotencyKeyLength)})
+		}
+
+		key = scopedIdempotencyKey(c, key)
+
+		h := sha256.New()
+		h.Write([]byte(c.Method() + " " + c.Path() + "\n"))
+		h.Write(c.Body())
+		requestHash := hex.EncodeToString(h.Sum(nil))
+
+		ctx := c.UserContext()
+
+		// キーを処理中（status = 0）として確保する
+		// 期限切れのキーと、処理中のまま放置されたキーは上書きして確保し直す
+		result, err := db.ExecContext(ctx, `
+			INSERT INTO idempotency_keys (key, request_hash) VALUES (?, ?)
+			ON CONFLICT(key) DO UPDATE SET
+				request_hash = excluded.request_hash,
+				status = 0,
+				content_type = NULL,
+				response = NULL,
+				created_at = excluded.created_at
+			WHERE created_at < datetime('now', 'localtime', ?)
+				OR (status = 0 AND created_at < datetime('now', 'localtime', ?))`,
+			key, requestHash, window, pending)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Idempotency check failed"})
+		}
+
+		if n, _ := result.RowsAffected(); n == 0 {
+			// すでに使われているキー
+			var storedHash, contentType string
+			var status int
+			var response []byte
+			err := db.QueryRowContext(ctx,
+				"SELECT request_hash, status, COALESCE(content_type, ''), response FROM idempotency_keys WHERE key = ?", key).
+				Scan(&storedHash, &status, &contentType, &response)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Idempotency check failed"})
+			}
+			if storedHash != requestHash {
+				return c.Status(409).JSON(fiber.Map{"error": "Idempotency-Key has already been used for a different request"})
+			}
+			if status == 0 {
+				return c.Status(409).JSON(fiber.Map{"error": "A request with this Idempotency-Key is still being processed"})
+			}
+			// 最初のレスポンスをそのまま返す
+			c.Set(idempotencyReplayedHeader, "true")
+			if contentType != "" {
+				c.Set(fiber.HeaderContentType, contentType)
+			}
+			return c.Status(status).Send(response)
+		}
+
+		chainErr := c.Next()
+		status := c.Response().StatusCode()
+
+		if chainErr != nil || status >= 500 {
+			// 失敗したリクエストは記録せず、再送で再実行できるようにする
+			if _, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE key = ?", key); err != nil {
+				log.Printf("Idempotency key release failed: %v", err)
+			}
+			return chainErr
+		}
+
+		_, err = db.ExecContext(ctx,
+			"UPDATE idempotency_keys SET status = ?, content_type = ?, response = ? WHERE key = ?",
+			status, string(c.Response().Header.ContentType()), c.Response().Body(), key)
+		if err != nil {
+			log.Printf("Idempotency response save failed: %v", err)
+		}
+		return nil
+	}
+}
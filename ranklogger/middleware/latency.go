@@ -1,59 +1,241 @@
 package middleware
 
 import (
-	"github.com/gofiber/fiber/v2"
+	"errors"
+	"math/bits"
 	"sort"
 	"sync"
 	"time"
+
+	"github.com/gofiber/fiber/v2"
 )
 
+// ヒストグラムのバケット設計（HDRヒストグラムと同じ考え方の対数線形バケット）
+// マイクロ秒の値を 2^n ごとの区間に分け、各区間をさらに16等分する
+// 相対誤差は最大でも約6%に収まり、1µs〜約300時間までを固定長の配列で扱える
+const (
+	subBucketBits  = 4
+	subBucketCount = 1 << subBucketBits
+	maxShift       = 36
+	bucketCount    = subBucketCount + (maxShift+1)*subBucketCount
+
+	// 時間窓は1分単位のスロットを60個持つリングバッファで表現する（最大1時間）
+	slotSeconds = 60
+	slotCount   = 60
+)
+
+// 集計対象の時間窓
+var LatencyWindows = map[string]int{
+	"1m": 1,
+	"5m": 5,
+	"1h": 60,
+}
+
+// マージ可能な固定長のヒストグラム
+type histogram struct {
+	counts       [bucketCount]uint64
+	total        uint64
+	clientErrors uint64 // 4xx
+	serverErrors uint64 // 5xx
+}
+
+func bucketIndex(us uint64) int {
+	if us < subBucketCount {
+		return int(us)
+	}
+	shift := bits.Len64(us) - (subBucketBits + 1)
+	if shift > maxShift {
+		return bucketCount - 1
+	}
+	mantissa := us >> uint(shift) // subBucketCount 〜 2*subBucketCount-1
+	return subBucketCount + shift*subBucketCount + int(mantissa-subBucketCount)
+}
+
+// バケットの代表値（区間の中央値）をマイクロ秒で返す
+func bucketValue(index int) float64 {
+	if index < subBucketCount {
+		return float64(index)
+	}
+	shift := (index - subBucketCount) / subBucketCount
+	mantissa := uint64(index-subBucketCount)%subBucketCount + subBucketCount
+	lower := mantissa << uint(shift)
+	upper := (mantissa + 1) << uint(shift)
+	return float64(lower+upper-1) / 2
+}
+
+func (h *histogram) add(us uint64, status int) {
+	h.counts[bucketIndex(us)]++
+	h.total++
+	switch {
+	case status >= 500:
+		h.serverErrors++
+	case status >= 400:
+		h.clientErrors++
+	}
+}
+
+func (h *histogram) merge(other *histogram) {
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	h.total += other.total
+	h.clientErrors += other.clientErrors
+	h.serverErrors += other.serverErrors
+}
+
+// パーセンタイル値をミリ秒で返す
+func (h *histogram) percentile(p float64) float64 {
+	if h.total == 0 {
+		return 0
+	}
+	// 旧実装と同じく「(件数-1) * p」番目の値を返す
+	rank := uint64(p / 100.0 * float64(h.total-1))
+	var seen uint64
+	for i, n := range h.counts {
+		seen += n
+		if seen > rank {
+			return bucketValue(i) / 1000.0
+		}
+	}
+	return bucketValue(bucketCount-1) / 1000.0
+}
+
+// ルート単位の時間窓付きヒストグラム
+type routeStats struct {
+	mu    sync.Mutex
+	slots [slotCount]histogram
+	stamp [slotCount]int64 // 各スロットがどの分のデータを持っているか
+}
+
+func (r *routeStats) record(now time.Time, us uint64, status int) {
+	minute := now.Unix() / slotSeconds
+	i := minute % slotCount
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stamp[i] != minute {
+		// 古い分のデータが残っているスロットは再利用する
+		r.slots[i] = histogram{}
+		r.stamp[i] = minute
+	}
+	r.slots[i].add(us, status)
+}
+
+// 直近minutes分のスロットをまとめたヒストグラムを返す
+func (r *routeStats) window(now time.Time, minutes int, dst *histogram) {
+	current := now.Unix() / slotSeconds
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.slots {
+		if age := current - r.stamp[i]; age >= 0 && age < int64(minutes) {
+			dst.merge(&r.slots[i])
+		}
+	}
+}
+
+type routeKey struct {
+	Method string
+	Path   string
+}
+
 type LatencyStats struct {
-	mu      sync.Mutex
-	samples []float64
-	maxSize int
+	mu     sync.RWMutex
+	routes map[routeKey]*routeStats
 }
 
-func NewLatencyStats(size int) *LatencyStats {
+func NewLatencyStats() *LatencyStats {
 	return &LatencyStats{
-		maxSize: size,
-		samples: make([]float64, 0, size),
+		routes: make(map[routeKey]*routeStats),
 	}
 }
 
-func (s *LatencyStats) Record(d time.Duration) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *LatencyStats) Record(method, path string, d time.Duration, status int) {
+	key := routeKey{Method: method, Path: path}
 
-	// ミリ秒単位で記録
-	s.samples = append(s.samples, float64(d.Microseconds())/1000.0)
+	s.mu.RLock()
+	r, ok := s.routes[key]
+	s.mu.RUnlock()
+	if !ok {
+		s.mu.Lock()
+		if r, ok = s.routes[key]; !ok {
+			r = &routeStats{}
+			s.routes[key] = r
+		}
+		s.mu.Unlock()
+	}
 
-	// 古いデータを捨てる（リングバッファ的な簡易実装）
-	if len(s.samples) > s.maxSize {
-		s.samples = s.samples[1:]
+	us := d.Microseconds()
+	if us < 0 {
+		us = 0
 	}
+	r.record(time.Now(), uint64(us), status)
 }
 
-func (s *LatencyStats) GetPercentile(p float64) float64 {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// 集計結果（GetMetricsでそのままJSONにできる形）
+type LatencySummary struct {
+	Method          string  `json:"method,omitempty"`
+	Route           string  `json:"route,omitempty"`
+	P50             float64 `json:"p50"`
+	P95             float64 `json:"p95"`
+	P99             float64 `json:"p99"`
+	Samples         uint64  `json:"samples"`
+	ClientErrorRate float64 `json:"client_error_rate"`
+	ServerErrorRate float64 `json:"server_error_rate"`
+}
 
-	if len(s.samples) == 0 {
-		return 0
+func summarize(h *histogram) LatencySummary {
+	s := LatencySummary{
+		P50:     h.percentile(50),
+		P95:     h.percentile(95),
+		P99:     h.percentile(99),
+		Samples: h.total,
+	}
+	if h.total > 0 {
+		s.ClientErrorRate = float64(h.clientErrors) / float64(h.total)
+		s.ServerErrorRate = float64(h.serverErrors) / float64(h.total)
 	}
+	return s
+}
 
-	// 計算のためにコピーしてソート
-	tmp := make([]float64, len(s.samples))
-	copy(tmp, s.samples)
-	sort.Float64s(tmp)
+// Summary は直近minutes分の全体とエンドポイントごとの集計を返す
+// 計算量はルート数×バケット数で、リクエスト数には依存しない
+func (s *LatencyStats) Summary(minutes int) (LatencySummary, []LatencySummary) {
+	now := time.Now()
 
-	index := int(p / 100.0 * float64(len(tmp)-1))
-	return tmp[index]
-}
+	s.mu.RLock()
+	keys := make([]routeKey, 0, len(s.routes))
+	routes := make([]*routeStats, 0, len(s.routes))
+	for k, r := range s.routes {
+		keys = append(keys, k)
+		routes = append(routes, r)
+	}
+	s.mu.RUnlock()
 
-func (s *LatencyStats) SampleCount() int {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return len(s.samples)
+	var overall histogram
+	endpoints := make([]LatencySummary, 0, len(routes))
+	for i, r := range routes {
+		var h histogram
+		r.window(now, minutes, &h)
+		if h.total == 0 {
+			continue
+		}
+		overall.merge(&h)
+
+		summary := summarize(&h)
+		summary.Method = keys[i].Method
+		summary.Route = keys[i].Path
+		endpoints = append(endpoints, summary)
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Route != endpoints[j].Route {
+			return endpoints[i].Route < endpoints[j].Route
+		}
+		return endpoints[i].Method < endpoints[j].Method
+	})
+
+	return summarize(&overall), endpoints
 }
 
 // ミドルウェア本体
@@ -61,7 +243,20 @@ func NewLatencyMiddleware(stats *LatencyStats) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		start := time.Now()
 		err := c.Next()
-		stats.Record(time.Since(start))
+
+		// エラーハンドラーが動く前なので、返されたエラーからステータスを判定する
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var e *fiber.Error
+			if errors.As(err, &e) {
+				status = e.Code
+			}
+		}
+
+		// 実際のパスではなくルート定義（/records/:Tag?など）単位で集計する
+		route := c.Route()
+		stats.Record(c.Method(), route.Path, time.Since(start), status)
 		return err
 	}
 }
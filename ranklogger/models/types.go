@@ -5,11 +5,23 @@ type (
 		UUID      string                 `json:"uuid" validate:"required,uuid4"`   // UUID形式か
 		PlayCount *int                   `json:"play_count" validate:"play_count"` // もし設定で有効なら、1以上の整数が入ること
 		Data      map[string]interface{} `json:"data" validate:"required"`
+		PlayedAt  string                 `json:"played_at"` // 省略可能。クライアントでプレイした日時（RFC3339）
+	}
+
+	// まとめて送るレコードの1件分（タグはレコードごとに指定する）
+	BatchRecordItem struct {
+		GameRecordRequest
+		Tag string `json:"tag"`
+	}
+
+	PostRecordsBatchRequest struct {
+		Records []BatchRecordItem `json:"records" validate:"required,min=1"` // 中身はレコードごとに検証して結果を返す
 	}
 
 	LogInput struct {
-		Type    int    `json:"type" validate:"required,min=1"`        // 0は未定義とするならmin=1
-		Content string `json:"content" validate:"required,max=10000"` // 1ログの最大長を制限
+		Type    int                    `json:"type" validate:"required,min=1"`                     // 0は未定義とするならmin=1
+		Content string                 `json:"content" validate:"required_without=Data,max=10000"` // 1ログの最大長を制限（dataがあれば省略可能）
+		Data    map[string]interface{} `json:"data"`                                               // LOG_SCHEMAで定義した構造化データ（省略可能）
 	}
 
 	PostLogsRequest struct {
@@ -18,7 +30,55 @@ type (
 		Logs      []LogInput `json:"logs" validate:"required,min=1,max=300,dive"` // 1件以上のログを必須にし、中身も検証
 	}
 
+	// 一括インポートの1行分（NDJSONの1行、CSVの1行）
+	ImportRecordRow struct {
+		UUID      string                 `json:"uuid" validate:"required,uuid4"`
+		PlayCount *int                   `json:"play_count" validate:"play_count"`
+		Data      map[string]interface{} `json:"data" validate:"required"`
+		IPAddress string                 `json:"ip_address" validate:"omitempty,ip"` // 省略可能
+		CreatedAt string                 `json:"created_at"`                         // 省略時はインポートした日時
+		PlayedAt  string                 `json:"played_at"`
+		Disable   *bool                  `json:"disable"`
+	}
+
+	ImportLogRow struct {
+		UUID      string                 `json:"uuid" validate:"required,uuid4"`
+		PlayCount *int                   `json:"play_count" validate:"play_count"`
+		Type      int                    `json:"type" validate:"required,min=1"`
+		Content   string                 `json:"content" validate:"required_without=Data,max=10000"`
+		Data      map[string]interface{} `json:"data"`
+		IPAddress string                 `json:"ip_address" validate:"omitempty,ip"`
+		CreatedAt string                 `json:"created_at"`
+	}
+
 	DisableRecordRequest struct {
 		Disable bool `json:"disable"` // true で除外、false で復帰
 	}
+
+	PutPlayerRequest struct {
+		DisplayName string                 `json:"display_name" validate:"required,max=50"`
+		Country     string                 `json:"country" validate:"omitempty,iso3166_1_alpha2"` // ISO 3166-1 alpha-2（JP, USなど）
+		AvatarURL   string                 `json:"avatar_url" validate:"omitempty,http_url,max=2048"`
+		Data        map[string]interface{} `json:"data"` // PLAYER_SCHEMAで定義した項目
+	}
+
+	// 指定したプレイヤーだけのランキング（POST /leaderboards）
+	LeaderboardRequest struct {
+		UUIDs []string `json:"uuids" validate:"required,min=1,dive,uuid4"`
+	}
+
+	// グループの作成・変更（uuidsはメンバー全員を指定する）
+	GroupRequest struct {
+		Name      string   `json:"name" validate:"required,max=50"`
+		OwnerUUID string   `json:"owner_uuid" validate:"omitempty,uuid4"` // プレイヤーが作成・変更する場合は必須
+		UUIDs     []string `json:"uuids" validate:"dive,uuid4"`
+	}
+
+	RollbackRecordRequest struct {
+		SubmissionID int64 `json:"submission_id" validate:"required,min=1"` // 戻したい送信履歴のID
+	}
+
+	WebhookTestRequest struct {
+		Endpoint string `json:"endpoint" validate:"required"` // WEBHOOK:ENDPOINTSのNAME
+	}
 )
@@ -0,0 +1,151 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"ranklogger/config"
+)
+
+// アプリ全体で使うトレーサー
+// Initが呼ばれるまで（またはトレース無効時）はNoopのプロバイダーが使われるため、呼び出し側で有効/無効を気にする必要はない
+var tracer = otel.Tracer("ranklogger")
+
+// Init: 設定に応じてトレースのエクスポーターを初期化し、終了処理用の関数を返す
+func Init(cfg *config.Config) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+	if !cfg.Tracing.Enabled {
+		return noop, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var file *os.File // fileの出力先（停止時に閉じる）
+	switch strings.ToLower(cfg.Tracing.Exporter) {
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Tracing.OTLPEndpoint)}
+		if cfg.Tracing.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exp, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return noop, err
+		}
+		exporter = exp
+	case "file":
+		// オフラインでも確認できるよう、スパンをJSONでファイルに書き出す
+		if err := os.MkdirAll(filepath.Dir(cfg.Tracing.FilePath), 0o755); err != nil {
+			return noop, err
+		}
+		f, err := os.OpenFile(cfg.Tracing.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return noop, err
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return noop, err
+		}
+		exporter = exp
+		file = f
+	default:
+		return noop, fmt.Errorf("unknown tracing exporter: %s", cfg.Tracing.Exporter)
+	}
+
+	res := resource.NewSchemaless(attribute.String("service.name", cfg.Tracing.ServiceName))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	// 残りのスパンを書き出してから、出力先のファイルを閉じる
+	shutdown := func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}
+	return shutdown, nil
+}
+
+// Start: 処理の一部（バリデーションなど）を子スパンとして計測する
+func Start(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name)
+}
+
+// HasSpan: ctxが計測中のスパンを持っているか（リクエスト外のSQLをスパンにしないために使う）
+func HasSpan(ctx context.Context) bool {
+	return trace.SpanFromContext(ctx).SpanContext().IsValid()
+}
+
+// fasthttpのリクエストヘッダーをpropagationのキャリアとして扱う
+type headerCarrier struct{ c *fiber.Ctx }
+
+func (h headerCarrier) Get(key string) string { return h.c.Get(key) }
+func (h headerCarrier) Set(key, value string) { h.c.Request().Header.Set(key, value) }
+func (h headerCarrier) Keys() []string {
+	var keys []string
+	h.c.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// Middleware: リクエストごとにスパンを作り、c.UserContext()に載せる
+// ハンドラーやdatabaseパッケージがこのコンテキストでSQLを実行すると、その子スパンになる
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), headerCarrier{c})
+		ctx, span := tracer.Start(ctx, c.Method(), trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		c.SetUserContext(ctx)
+		err := c.Next()
+
+		// ルートはハンドラーの実行後に確定する
+		route := c.Route().Path
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var e *fiber.Error
+			if errors.As(err, &e) {
+				status = e.Code
+			}
+			span.RecordError(err)
+		}
+		span.SetName(c.Method() + " " + route)
+		span.SetAttributes(
+			attribute.String("http.request.method", c.Method()),
+			attribute.String("http.route", route),
+			attribute.String("url.path", c.Path()),
+			attribute.Int("http.response.status_code", status),
+		)
+		if rid, ok := c.Locals("requestid").(string); ok {
+			span.SetAttributes(attribute.String("request.id", rid))
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", status))
+		}
+		return err
+	}
+}
@@ -0,0 +1,407 @@
+package webhook
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"ranklogger/config"
+	"ranklogger/events"
+)
+
+// 通知するイベント（configのWEBHOOK:ENDPOINTSのEVENTSで指定する）
+const (
+	EventRecordCreated  = "record.created"  // 新しいレコード（セッション）が登録された
+	EventRecordNewTop   = "record.new_top"  // ランキング項目で1位になった
+	EventRecordDisabled = "record.disabled" // レコードが無効化された（コンテンツフィルター、管理者）
+	EventLogsErrorType  = "logs.error_type" // ERROR_LOG_TYPESの種類のログが登録された
+	EventPing           = "ping"            // 管理者による送信テスト（EVENTSに関係なく送る）
+)
+
+// 送信の状態
+const (
+	StatusPending   = "pending"   // 送信待ち（再送待ちを含む）
+	StatusSending   = "sending"   // 送信中
+	StatusDelivered = "delivered" // 2xxが返された
+	StatusFailed    = "failed"    // MAX_ATTEMPTS回失敗した
+)
+
+// ErrUnknownEndpoint: WEBHOOK:ENDPOINTSにない送信先が指定された
+var ErrUnknownEndpoint = errors.New("endpoint is not configured")
+
+// ErrSending: 送信中のものは再送できない
+var ErrSending = errors.New("delivery is being sent")
+
+// 1回に取り出す送信待ちの数
+const batchSize = 20
+
+// 送信先から返された本文のうち、記録する長さ
+const maxErrorBody = 200
+
+// DBとトランザクションのどちらでも登録できるようにする
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Dispatcher: Webhookの送信待ちをDBに登録し、バックグラウンドで送信・再送する
+// 送信待ちは通知の元になった変更と同じトランザクションで登録するため、変更が確定したものだけが送られる
+type Dispatcher struct {
+	db     *sql.DB
+	cfg    *config.Config
+	client *http.Client
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Start: 送信を開始する（無効の場合は何もしない。Enqueueも何も登録しない）
+// レコードやログの登録（Brokerの通知）があるとすぐに、それ以外はPOLL_INTERVAL_SECONDSごとに送信待ちを確認する
+func Start(db *sql.DB, cfg *config.Config, broker *events.Broker) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		db:     db,
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Duration(cfg.Webhook.TimeoutSeconds) * time.Second},
+		wake:   make(chan struct{}, 1),
+		cancel: cancel,
+	}
+	if !cfg.Webhook.Enabled {
+		return d
+	}
+
+	// 送信中に停止した（強制終了など）ものは、送信待ちに戻して送り直す
+	if _, err := db.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ? WHERE status = ?",
+		StatusPending, StatusSending); err != nil {
+		log.Printf("Webhook recovery failed: %v", err)
+	}
+
+	records := broker.Subscribe(events.TopicRecords, 1)
+	logs := broker.Subscribe(events.TopicLogs, 1)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer records.Close()
+		defer logs.Close()
+		d.loop(ctx, records.C, logs.C)
+	}()
+	return d
+}
+
+// Stop: 送信中のものが終わるまで待ってから停止する（送信待ちは次の起動時に送る）
+func (d *Dispatcher) Stop() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// Wants: イベントを受け取る送信先があるか（通知内容の作成に手間がかかるイベントで、先に確認する用）
+func (d *Dispatcher) Wants(event string) bool {
+	if d == nil || !d.cfg.Webhook.Enabled {
+		return false
+	}
+	for _, ep := range d.cfg.Webhook.Endpoints {
+		if slices.Contains(ep.Events, event) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enqueue: イベントを受け取るすべての送信先に、送信待ちを登録する
+// qに呼び出し元のトランザクションを渡すと、コミットされたときだけ送られる
+func (d *Dispatcher) Enqueue(ctx context.Context, q execer, event string, data interface{}) error {
+	if !d.Wants(event) {
+		return nil
+	}
+	payload, err := buildPayload(event, data)
+	if err != nil {
+		return err
+	}
+	for _, ep := range d.cfg.Webhook.Endpoints {
+		if !slices.Contains(ep.Events, event) {
+			continue
+		}
+		if err := insertDelivery(ctx, q, ep.Name, event, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ping: 送信テストのイベントを1つの送信先に登録して、すぐに送る
+func (d *Dispatcher) Ping(ctx context.Context, endpoint string) (int64, error) {
+	if _, ok := d.endpoint(endpoint); !ok {
+		return 0, ErrUnknownEndpoint
+	}
+	payload, err := buildPayload(EventPing, map[string]interface{}{"endpoint": endpoint})
+	if err != nil {
+		return 0, err
+	}
+	result, err := d.db.ExecContext(ctx,
+		"INSERT INTO webhook_deliveries (endpoint, event, payload) VALUES (?, ?, ?)", endpoint, EventPing, payload)
+	if err != nil {
+		return 0, err
+	}
+	d.Wake()
+	return result.LastInsertId()
+}
+
+// Retry: 送信済み・失敗したものを含めて、もう一度送る
+// 送信回数は引き継ぐため、失敗した場合はMAX_ATTEMPTSに達するまで通常どおり間隔を空けて再送する（達していれば再送しない）
+// 対象がない場合はsql.ErrNoRows、送信中の場合はErrSendingを返す
+func (d *Dispatcher) Retry(ctx context.Context, id int64) error {
+	result, err := d.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = ?, next_attempt_at = datetime('now', 'localtime')
+		WHERE id = ? AND status != ?`, StatusPending, id, StatusSending)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		var status string
+		if err := d.db.QueryRowContext(ctx, "SELECT status FROM webhook_deliveries WHERE id = ?", id).Scan(&status); err != nil {
+			return err
+		}
+		return ErrSending
+	}
+	d.Wake()
+	return nil
+}
+
+// Wake: 次の確認を待たずに送信待ちを送る
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func buildPayload(event string, data interface{}) (string, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"event":      event,
+		"created_at": time.Now().Format(time.RFC3339),
+		"data":       data,
+	})
+	return string(payload), err
+}
+
+func insertDelivery(ctx context.Context, q execer, endpoint, event, payload string) error {
+	_, err := q.ExecContext(ctx,
+		"INSERT INTO webhook_deliveries (endpoint, event, payload) VALUES (?, ?, ?)", endpoint, event, payload)
+	return err
+}
+
+func (d *Dispatcher) endpoint(name string) (config.WebhookEndpoint, bool) {
+	for _, ep := range d.cfg.Webhook.Endpoints {
+		if ep.Name == name {
+			return ep, true
+		}
+	}
+	return config.WebhookEndpoint{}, false
+}
+
+func (d *Dispatcher) loop(ctx context.Context, records, logs <-chan events.Event) {
+	ticker := time.NewTicker(time.Duration(d.cfg.Webhook.PollIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		d.deliverDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		// Brokerが先に終了した場合は、閉じたチャネルを待たないようにする
+		case _, ok := <-records:
+			if !ok {
+				records = nil
+			}
+		case _, ok := <-logs:
+			if !ok {
+				logs = nil
+			}
+		}
+	}
+}
+
+type delivery struct {
+	id       int64
+	endpoint string
+	event    string
+	payload  string
+	attempts int
+}
+
+// deliverDue: 送信時刻を過ぎた送信待ちがなくなるまで送る
+func (d *Dispatcher) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		due, err := d.fetchDue(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Webhook fetch failed: %v", err)
+			}
+			return
+		}
+		for _, dl := range due {
+			if err := d.deliver(ctx, dl); err != nil && ctx.Err() == nil {
+				log.Printf("Webhook delivery %d update failed: %v", dl.id, err)
+			}
+		}
+		if len(due) < batchSize {
+			return
+		}
+	}
+}
+
+// fetchDue: 送信時刻を過ぎた送信待ちを送信中にして取り出す（送信中のものはRetryで送信待ちに戻されない）
+func (d *Dispatcher) fetchDue(ctx context.Context) ([]delivery, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		UPDATE webhook_deliveries SET status = ?
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = ? AND next_attempt_at <= datetime('now', 'localtime')
+			ORDER BY id LIMIT ?
+		)
+		RETURNING id, endpoint, event, payload, attempts`, StatusSending, StatusPending, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []delivery
+	for rows.Next() {
+		var dl delivery
+		if err := rows.Scan(&dl.id, &dl.endpoint, &dl.event, &dl.payload, &dl.attempts); err != nil {
+			return nil, err
+		}
+		due = append(due, dl)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNINGの順序は決まっていないため、登録順に並べ直す
+	slices.SortFunc(due, func(a, b delivery) int { return cmp.Compare(a.id, b.id) })
+	return due, nil
+}
+
+// deliver: 1件送信し、結果（試行履歴と状態）を記録する
+func (d *Dispatcher) deliver(ctx context.Context, dl delivery) error {
+	attempt := dl.attempts + 1
+	start := time.Now()
+	var statusCode interface{}
+	var sendErr string
+
+	ep, ok := d.endpoint(dl.endpoint)
+	if !ok {
+		// 設定から削除された送信先には送らない
+		sendErr = ErrUnknownEndpoint.Error()
+	} else {
+		code, err := d.send(ctx, ep, dl)
+		if code != 0 {
+			statusCode = code
+		}
+		if err != nil {
+			sendErr = err.Error()
+		}
+	}
+	if ctx.Err() != nil {
+		// 停止による中断は失敗として数えず、送信待ちに戻す
+		_, err := d.db.ExecContext(context.Background(),
+			"UPDATE webhook_deliveries SET status = ? WHERE id = ?", StatusPending, dl.id)
+		return err
+	}
+	durationMs := float64(time.Since(start).Microseconds()) / 1000.0
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var lastError interface{}
+	if sendErr != "" {
+		lastError = sendErr
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO webhook_attempts (delivery_id, attempt, status_code, error, duration_ms)
+		VALUES (?, ?, ?, ?, ?)`, dl.id, attempt, statusCode, lastError, durationMs); err != nil {
+		return err
+	}
+
+	switch {
+	case sendErr == "":
+		_, err = tx.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET status = ?, attempts = ?, last_status_code = ?, last_error = NULL, delivered_at = datetime('now', 'localtime')
+			WHERE id = ?`, StatusDelivered, attempt, statusCode, dl.id)
+	case !ok || attempt >= d.cfg.Webhook.MaxAttempts:
+		_, err = tx.ExecContext(ctx, `
+			UPDATE webhook_deliveries SET status = ?, attempts = ?, last_status_code = ?, last_error = ?
+			WHERE id = ?`, StatusFailed, attempt, statusCode, lastError, dl.id)
+		log.Printf("Webhook delivery %d to %s failed after %d attempts: %s", dl.id, dl.endpoint, attempt, sendErr)
+	default:
+		_, err = tx.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET status = ?, attempts = ?, last_status_code = ?, last_error = ?, next_attempt_at = datetime('now', 'localtime', ?)
+			WHERE id = ?`, StatusPending, attempt, statusCode, lastError, fmt.Sprintf("+%d seconds", d.backoff(attempt)), dl.id)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// backoff: n回目の失敗の後、次に送るまでの秒数（BACKOFF_BASE_SECONDSから倍々に増やし、BACKOFF_MAX_SECONDSで止める）
+func (d *Dispatcher) backoff(n int) int {
+	wait := d.cfg.Webhook.BackoffBaseSeconds
+	for i := 1; i < n && wait < d.cfg.Webhook.BackoffMaxSeconds; i++ {
+		wait *= 2
+	}
+	return min(wait, d.cfg.Webhook.BackoffMaxSeconds)
+}
+
+// send: 署名を付けて送信し、ステータスコードを返す（2xx以外はエラー）
+// 署名は "タイムスタンプ.本文" のHMAC-SHA256（受信側はタイムスタンプで古い再送を弾ける）
+func (d *Dispatcher) send(ctx context.Context, ep config.WebhookEndpoint, dl delivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.URL, bytes.NewBufferString(dl.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "RankLogger-Webhook")
+	req.Header.Set("X-RankLogger-Event", dl.event)
+	req.Header.Set("X-RankLogger-Delivery", strconv.FormatInt(dl.id, 10))
+	req.Header.Set("X-RankLogger-Timestamp", timestamp)
+	req.Header.Set("X-RankLogger-Signature", "sha256="+Sign(ep.Secret, timestamp, dl.payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("HTTP %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign: 署名（16進数）を作る。受信側も同じ計算をして X-RankLogger-Signature と比べる
+func Sign(secret, timestamp, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
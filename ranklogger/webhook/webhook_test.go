@@ -0,0 +1,237 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"ranklogger/config"
+	"ranklogger/database"
+)
+
+const testSecret = "test-webhook-secret"
+
+// receiver: 受け取ったリクエストを記録し、statusesの順にステータスコードを返す（最後の値はその後も繰り返す）
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, string(body))
+	status := r.statuses[min(len(r.requests), len(r.statuses))-1]
+	w.WriteHeader(status)
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+// newTestDispatcher: 一時ファイルのDBと送信先のテスト用サーバーを使うDispatcher（バックグラウンドの送信は開始しない）
+func newTestDispatcher(t *testing.T, statuses ...int) (*Dispatcher, *receiver) {
+	t.Helper()
+	recv := &receiver{statuses: statuses}
+	srv := httptest.NewServer(recv)
+	t.Cleanup(srv.Close)
+
+	cfg := &config.Config{}
+	cfg.Server.DBPath = filepath.Join(t.TempDir(), "test.db")
+	cfg.Webhook = config.WebhookConfig{
+		Enabled:            true,
+		TimeoutSeconds:     5,
+		MaxAttempts:        3,
+		BackoffBaseSeconds: 30,
+		BackoffMaxSeconds:  100,
+		Endpoints: []config.WebhookEndpoint{{
+			Name:   "test",
+			URL:    srv.URL,
+			Secret: testSecret,
+			Events: []string{EventRecordCreated},
+		}},
+	}
+	db, err := database.InitDB(cfg)
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	d := &Dispatcher{db: db, cfg: cfg, client: srv.Client(), wake: make(chan struct{}, 1)}
+	return d, recv
+}
+
+// enqueue: 送信待ちを1件登録し、そのidを返す
+func enqueue(t *testing.T, d *Dispatcher) int64 {
+	t.Helper()
+	ctx := context.Background()
+	if err := d.Enqueue(ctx, d.db, EventRecordCreated, map[string]interface{}{"session_id": 1}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	var id int64
+	if err := d.db.QueryRowContext(ctx, "SELECT MAX(id) FROM webhook_deliveries").Scan(&id); err != nil {
+		t.Fatalf("select id: %v", err)
+	}
+	return id
+}
+
+// makeDue: 再送の時刻を待たずに送れるようにする
+func makeDue(t *testing.T, d *Dispatcher, id int64) {
+	t.Helper()
+	if _, err := d.db.Exec("UPDATE webhook_deliveries SET next_attempt_at = datetime('now', 'localtime', '-1 seconds') WHERE id = ?", id); err != nil {
+		t.Fatalf("update next_attempt_at: %v", err)
+	}
+}
+
+func deliveryState(t *testing.T, d *Dispatcher, id int64) (status string, attempts int) {
+	t.Helper()
+	if err := d.db.QueryRow("SELECT status, attempts FROM webhook_deliveries WHERE id = ?", id).Scan(&status, &attempts); err != nil {
+		t.Fatalf("select delivery: %v", err)
+	}
+	return status, attempts
+}
+
+func TestSign(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write([]byte("1700000000.{\"event\":\"ping\"}"))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if got := Sign(testSecret, "1700000000", `{"event":"ping"}`); got != want {
+		t.Errorf("Sign = %s, want %s", got, want)
+	}
+	if Sign("other-secret", "1700000000", `{"event":"ping"}`) == want {
+		t.Error("Sign must depend on the secret")
+	}
+}
+
+func TestDeliverSignsRequest(t *testing.T) {
+	d, recv := newTestDispatcher(t, http.StatusOK)
+	id := enqueue(t, d)
+
+	d.deliverDue(context.Background())
+
+	if status, attempts := deliveryState(t, d, id); status != StatusDelivered || attempts != 1 {
+		t.Fatalf("delivery = %s/%d, want %s/1", status, attempts, StatusDelivered)
+	}
+	if recv.count() != 1 {
+		t.Fatalf("requests = %d, want 1", recv.count())
+	}
+	req, body := recv.requests[0], recv.bodies[0]
+	if got := req.Header.Get("X-RankLogger-Event"); got != EventRecordCreated {
+		t.Errorf("X-RankLogger-Event = %q", got)
+	}
+	want := "sha256=" + Sign(testSecret, req.Header.Get("X-RankLogger-Timestamp"), body)
+	if got := req.Header.Get("X-RankLogger-Signature"); got != want {
+		t.Errorf("X-RankLogger-Signature = %q, want %q", got, want)
+	}
+}
+
+func TestDeliverRetriesAfterServerError(t *testing.T) {
+	d, recv := newTestDispatcher(t, http.StatusInternalServerError, http.StatusOK)
+	id := enqueue(t, d)
+	ctx := context.Background()
+
+	d.deliverDue(ctx)
+	if status, attempts := deliveryState(t, d, id); status != StatusPending || attempts != 1 {
+		t.Fatalf("after 5xx: delivery = %s/%d, want %s/1", status, attempts, StatusPending)
+	}
+	// 次の送信はBACKOFF_BASE_SECONDS後
+	var wait int
+	if err := d.db.QueryRow(`
+		SELECT CAST(round((julianday(next_attempt_at) - julianday('now', 'localtime')) * 86400) AS INTEGER)
+		FROM webhook_deliveries WHERE id = ?`, id).Scan(&wait); err != nil {
+		t.Fatal(err)
+	}
+	if wait < 29 || wait > 30 {
+		t.Errorf("next attempt in %ds, want 30s", wait)
+	}
+	// 時刻になるまでは送らない
+	d.deliverDue(ctx)
+	if recv.count() != 1 {
+		t.Fatalf("sent before backoff: requests = %d, want 1", recv.count())
+	}
+
+	makeDue(t, d, id)
+	d.deliverDue(ctx)
+	if status, attempts := deliveryState(t, d, id); status != StatusDelivered || attempts != 2 {
+		t.Fatalf("after retry: delivery = %s/%d, want %s/2", status, attempts, StatusDelivered)
+	}
+	var history int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM webhook_attempts WHERE delivery_id = ?", id).Scan(&history); err != nil {
+		t.Fatal(err)
+	}
+	if history != 2 {
+		t.Errorf("attempts recorded = %d, want 2", history)
+	}
+}
+
+func TestDeliverGivesUpAfterMaxAttempts(t *testing.T) {
+	d, recv := newTestDispatcher(t, http.StatusServiceUnavailable)
+	id := enqueue(t, d)
+	ctx := context.Background()
+
+	for i := 0; i < d.cfg.Webhook.MaxAttempts+1; i++ {
+		makeDue(t, d, id)
+		d.deliverDue(ctx)
+	}
+	if status, attempts := deliveryState(t, d, id); status != StatusFailed || attempts != d.cfg.Webhook.MaxAttempts {
+		t.Fatalf("delivery = %s/%d, want %s/%d", status, attempts, StatusFailed, d.cfg.Webhook.MaxAttempts)
+	}
+	if recv.count() != d.cfg.Webhook.MaxAttempts {
+		t.Errorf("requests = %d, want %d", recv.count(), d.cfg.Webhook.MaxAttempts)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d, _ := newTestDispatcher(t, http.StatusOK)
+	for n, want := range map[int]int{1: 30, 2: 60, 3: 100, 10: 100} {
+		if got := d.backoff(n); got != want {
+			t.Errorf("backoff(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	d, _ := newTestDispatcher(t, http.StatusOK)
+	id := enqueue(t, d)
+	ctx := context.Background()
+
+	// 送信中のものは送信待ちに戻さない
+	if _, err := d.db.Exec("UPDATE webhook_deliveries SET status = ? WHERE id = ?", StatusSending, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Retry(ctx, id); !errors.Is(err, ErrSending) {
+		t.Errorf("Retry(sending) = %v, want ErrSending", err)
+	}
+	if status, _ := deliveryState(t, d, id); status != StatusSending {
+		t.Errorf("status = %s, want %s", status, StatusSending)
+	}
+
+	if _, err := d.db.Exec("UPDATE webhook_deliveries SET status = ? WHERE id = ?", StatusFailed, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Retry(ctx, id); err != nil {
+		t.Fatalf("Retry(failed) = %v", err)
+	}
+	if status, _ := deliveryState(t, d, id); status != StatusPending {
+		t.Errorf("status = %s, want %s", status, StatusPending)
+	}
+
+	if err := d.Retry(ctx, id+100); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Retry(unknown) = %v, want sql.ErrNoRows", err)
+	}
+}